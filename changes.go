@@ -0,0 +1,164 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"time"
+
+	"github.com/andrebq/ograph/data"
+)
+
+type (
+	// A position in the change log, it can be stored by the readers to
+	// resume later. The empty Cursor is the beginning of the log.
+	Cursor string
+
+	// Is a node, a relation or a relation name
+	ChangeKind string
+
+	// Is insert, update or delete
+	ChangeOp string
+
+	// A node or relation written to or removed from the graph, or a relation
+	// name renamed or removed, see G.Changes
+	Change struct {
+		Cursor Cursor
+		Kind   ChangeKind
+		Op     ChangeOp
+		// the node changed, or the node at each end of the relation
+		Node     Nid
+		From, To Nid
+		Relation Rid
+		// the name of the node, the name of the relation when it was
+		// written or the new name of a renamed relation name
+		Name string
+		// the name before a RelationNameChange
+		OldName string
+		At      time.Time
+	}
+
+	// Subscription calls a function for each change as they are committed,
+	// see G.Subscribe
+	Subscription struct {
+		sub *data.Subscription
+	}
+)
+
+const (
+	NodeChange         = ChangeKind("node")
+	RelationChange     = ChangeKind("relation")
+	RelationNameChange = ChangeKind("keyword")
+
+	Inserted = ChangeOp("insert")
+	Updated  = ChangeOp("update")
+	Deleted  = ChangeOp("delete")
+)
+
+// Changes returns at most limit changes made after since, in order.
+// Every SaveAll, DeleteAll and the relations removed with a node are recorded,
+// a Node that is saved without changing still produces an update.
+// RenameRelation and DeleteRelationName produce a RelationNameChange.
+//
+//	changes, err := g.Changes(cursor, 100)
+//	for _, c := range changes {
+//		cache.Forget(c.Node)
+//		cursor = c.Cursor
+//	}
+//
+// A change is only returned after every transaction older than it ends, so
+// a long transaction delays the changes made after it started.
+func (g *G) Changes(since Cursor, limit int) (_ []Change, err error) {
+	defer g.returnError(&err)
+	cursor, err := data.ParseCursor(string(since))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := g.repo.Changes(cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Change, len(raw))
+	for i := range raw {
+		out[i] = change(&raw[i])
+	}
+	return out, nil
+}
+
+// TrimChanges removes the changes up to and including upTo, the log grows
+// until it is trimmed. upTo should be the oldest cursor still used by a reader.
+func (g *G) TrimChanges(upTo Cursor) (err error) {
+	defer g.returnError(&err)
+	cursor, err := data.ParseCursor(string(upTo))
+	if err != nil {
+		return err
+	}
+	_, err = g.repo.TrimChanges(cursor)
+	return err
+}
+
+// Subscribe calls fn with the changes made after since and then with the new
+// ones, as they are committed, using LISTEN/NOTIFY. fn is called from another
+// goroutine and must not use g, the returned Subscription is stopped by Close.
+func (g *G) Subscribe(since Cursor, fn func(Change) error) (_ *Subscription, err error) {
+	defer g.returnError(&err)
+	cursor, err := data.ParseCursor(string(since))
+	if err != nil {
+		return nil, err
+	}
+	sub, err := g.repo.Subscribe(cursor, func(c *data.Change) error {
+		return fn(change(c))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{sub: sub}, nil
+}
+
+// Cursor waits for the subscription to stop and returns the cursor of the
+// last change given to fn, which can be used to resume it
+func (s *Subscription) Cursor() Cursor {
+	return Cursor(s.sub.Cursor().String())
+}
+
+// Close stops the subscription and returns the error that stopped it, if any
+func (s *Subscription) Close() error {
+	return s.sub.Close()
+}
+
+func change(c *data.Change) Change {
+	out := Change{
+		Cursor: Cursor(c.Cursor.String()),
+		Kind:   ChangeKind(c.Kind),
+		Op:     ChangeOp(c.Op),
+		At:     c.At,
+	}
+	switch out.Kind {
+	case NodeChange:
+		out.Node = Nid(c.Gid)
+		out.Name = c.Name
+	case RelationNameChange:
+		out.Name, out.OldName = c.Keyword, c.OldKeyword
+	default:
+		out.Relation = Rid(c.Rid)
+		out.From, out.To = Nid(c.FromGid), Nid(c.ToGid)
+		out.Name = c.Keyword
+	}
+	return out
+}
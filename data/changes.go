@@ -0,0 +1,249 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type (
+	// Cursor is a position in the change log, the zero value is its beginning.
+	//
+	// Changes are ordered by the transaction that made them and then by
+	// their id, and only changes from transactions older than every running
+	// transaction are read. A change committed after a read can't appear
+	// before the cursor of that read.
+	Cursor struct {
+		Tx uint64
+		Id uint64
+	}
+
+	// Change is one row written to or removed from the nodes or the relations,
+	// or a keyword renamed or removed
+	Change struct {
+		// Cursor of the change, pass it to Changes to read the ones after it
+		Cursor Cursor
+		// Kind is node, relation or keyword
+		Kind string
+		// Op is insert, update or delete. Keywords are only updated (renamed)
+		// or deleted.
+		Op string
+		// Gid and Name of the node
+		Gid  uint64
+		Name string
+		// Rid, endpoints and name (Keyword) of the relation, the name is
+		// the one it had when the relation was written
+		Rid     uint64
+		FromGid uint64
+		ToGid   uint64
+		Keyword string
+		// the name of a renamed or removed keyword, Keyword is the new one
+		OldKeyword string
+		At         time.Time
+	}
+
+	// Subscription calls a function for each change as they are committed,
+	// see Subscribe
+	Subscription struct {
+		repo     *Repo
+		listener *pq.Listener
+		cursor   Cursor
+		fn       func(*Change) error
+		err      error
+		done     chan struct{}
+		stopped  chan struct{}
+		close    sync.Once
+	}
+)
+
+const (
+	// ChangesChannel is the channel notified by every transaction that changes
+	// nodes, relations or keywords
+	ChangesChannel = "ograph_changes"
+
+	// SubscriptionPoll is how often a Subscription reads the change log without
+	// a notification, which is needed when a transaction that committed
+	// changes had to wait for an older one to finish
+	SubscriptionPoll = time.Second
+
+	// changes read by each query of a Subscription
+	subscriptionBatch = 100
+)
+
+const (
+	// changes logged before the keyword column existed use the current name
+	selectChanges = `select c.tx, c.cid, c.kind, c.op, coalesce(c.gid, 0), coalesce(c.name, ''),
+		coalesce(c.rid, 0), coalesce(c.from_, 0), coalesce(c.to_, 0),
+		coalesce(c.keyword, case when c.kind = 'relation' then kw.name end, ''),
+		coalesce(c.old_keyword, ''), c.at
+		from changes c
+			left join keywords kw
+				on kw.kid = c.field
+		where (c.tx, c.cid) > ($1, $2) and c.tx < txid_snapshot_xmin(txid_current_snapshot())
+		order by c.tx, c.cid
+		limit $3`
+	trimChanges = `delete from changes where (tx, cid) <= ($1, $2)`
+)
+
+// String encodes the cursor so it can be stored, see ParseCursor
+func (c Cursor) String() string {
+	return fmt.Sprintf("%v.%v", c.Tx, c.Id)
+}
+
+// ParseCursor decodes the output of Cursor.String, an empty string is the zero Cursor
+func ParseCursor(s string) (Cursor, error) {
+	var c Cursor
+	if len(s) == 0 {
+		return c, nil
+	}
+	if _, err := fmt.Sscanf(s, "%d.%d", &c.Tx, &c.Id); err != nil {
+		return c, fmt.Errorf("invalid cursor %q", s)
+	}
+	return c, nil
+}
+
+// Changes returns at most limit changes after since, in order.
+// Changes are recorded by triggers, so every write is logged, including
+// the relations removed by DeleteNode and the rows removed by DeleteAll.
+func (r *Repo) Changes(since Cursor, limit int) ([]Change, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var out []Change
+	err := r.eachRow(selectChanges, []interface{}{since.Tx, since.Id, limit}, func(rows *sql.Rows) error {
+		var c Change
+		err := rows.Scan(&c.Cursor.Tx, &c.Cursor.Id, &c.Kind, &c.Op, &c.Gid, &c.Name,
+			&c.Rid, &c.FromGid, &c.ToGid, &c.Keyword, &c.OldKeyword, &c.At)
+		if err != nil {
+			return err
+		}
+		out = append(out, c)
+		return nil
+	})
+	return out, err
+}
+
+// TrimChanges removes the changes up to and including upTo, the log isn't
+// trimmed otherwise. upTo should be the oldest cursor still used by a reader.
+func (r *Repo) TrimChanges(upTo Cursor) (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	result, err := r.exec(trimChanges, upTo.Tx, upTo.Id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Subscribe calls fn, from another goroutine, for each change after since and
+// then for the new ones, as they are committed. It uses LISTEN on ChangesChannel
+// with its own connection, so the Repo must have been created by Connect.
+//
+// An error from fn, or from the database, stops the subscription and is
+// returned by Close.
+func (r *Repo) Subscribe(since Cursor, fn func(*Change) error) (*Subscription, error) {
+	if len(r.dsn) == 0 {
+		return nil, errors.New("subscribe requires a Repo created by Connect")
+	}
+	listener := pq.NewListener(r.dsn, 10*time.Millisecond, time.Minute, nil)
+	if err := listener.Listen(ChangesChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	s := &Subscription{
+		// the Repo isn't safe for concurrent use, the subscription
+		// uses its own but shares the pool of connections
+		repo: &Repo{
+			Db:         r.Db,
+			Keywords:   r.Keywords,
+			Unprepared: r.Unprepared,
+		},
+		listener: listener,
+		cursor:   since,
+		fn:       fn,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Cursor waits for the subscription to stop and returns the cursor of the
+// last change given to fn, which can be used to resume it
+func (s *Subscription) Cursor() Cursor {
+	<-s.stopped
+	return s.cursor
+}
+
+// Close stops the subscription and returns the error that stopped it, if any
+func (s *Subscription) Close() error {
+	s.close.Do(func() { close(s.done) })
+	<-s.stopped
+	return s.err
+}
+
+func (s *Subscription) run() {
+	defer func() {
+		s.listener.Close()
+		s.repo.closeStatements()
+		close(s.stopped)
+	}()
+	poll := time.NewTicker(SubscriptionPoll)
+	defer poll.Stop()
+	for {
+		if s.err = s.read(); s.err != nil {
+			return
+		}
+		select {
+		case <-s.done:
+			return
+		case <-s.listener.Notify:
+			// a nil notification means the connection was lost and
+			// restored, reading again covers what was missed
+		case <-poll.C:
+		}
+	}
+}
+
+// read calls fn for every change after the cursor
+func (s *Subscription) read() error {
+	for {
+		changes, err := s.repo.Changes(s.cursor, subscriptionBatch)
+		if err != nil {
+			return err
+		}
+		for i := range changes {
+			if err := s.fn(&changes[i]); err != nil {
+				return err
+			}
+			s.cursor = changes[i].Cursor
+		}
+		if len(changes) < subscriptionBatch {
+			return nil
+		}
+	}
+}
@@ -22,8 +22,10 @@ package data
 import (
 	"database/sql"
 	"errors"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type (
@@ -31,20 +33,28 @@ type (
 		Gid uint64
 		Name string
 		Attributes string
+		// sorted, nil when the node doesn't have labels. When saving an
+		// existing node, nil keeps its labels and an empty slice removes them.
+		Labels []string
 	}
 
 	Relation struct {
 		FromGid uint64
 		FromName string
 		FromAttributes string
+		FromLabels []string
 
 		ToGid uint64
 		ToName string
 		ToAttributes string
+		ToLabels []string
 
 		Attributes string
 		Field uint32
 		Name string
+		// Rid identifies the relation, since with a Multi rule
+		// the same nodes can have many relations with the same name
+		Rid uint64
 	}
 
 	Keyword struct {
@@ -56,7 +66,54 @@ type (
 		Db Db
 		Transaction Transaction
 		err error
+		// the error returned by the last End, kept by Err until the next Begin
+		endErr error
 		AutoCommit bool
+
+		// Keywords caches the keywords, it is created by Connect
+		// and can be shared with other Repo values
+		Keywords *KeywordCache
+
+		// keywords created by the active transaction, only moved
+		// to Keywords after a commit
+		pendingKeywords []Keyword
+
+		// keywords renamed or removed by the active transaction
+		forgottenKeywords []Keyword
+
+		// Profile, when not nil, records every statement sent
+		// to the database, see Profile
+		Profile *Profile
+
+		// Hooks are called before and after every statement
+		Hooks []Hook
+
+		// Unprepared sends every statement as text. By default the constant
+		// statements are prepared once, which takes a free connection from
+		// the pool the first time each one is used.
+		Unprepared bool
+
+		// prepared statements, and their copies bound to the active transaction
+		stmts   map[string]*sql.Stmt
+		txStmts map[string]*sql.Stmt
+		// queries prepared by the active transaction that aren't in stmts yet
+		unprepared []string
+
+		// Metrics, when not nil, counts the writes, walks, keyword lookups
+		// and transactions. It can be shared with other Repo values.
+		Metrics *Metrics
+
+		// when the active transaction started
+		txStarted time.Time
+
+		// used by Subscribe to open its own connection
+		dsn string
+	}
+
+	// KeywordUsage is a keyword and the number of relations using it
+	KeywordUsage struct {
+		Keyword
+		Count int64
 	}
 
 	Querier interface {
@@ -79,8 +136,41 @@ type (
 
 	RelationSet []*Relation
 
+	// WalkOptions restricts the relations returned by WalkWith
+	WalkOptions struct {
+		// only relations to nodes that have all those labels
+		ToLabels []string
+
+		// Limit and After are used to read the relations in pages,
+		// the results are ordered by Rid and only the relations
+		// after the given Rid are returned. Limit 0 means no limit.
+		Limit int
+		After uint64
+
+		// OrderBy sorts the relations, ties are sorted by Rid.
+		// It cannot be used with After, use Offset instead.
+		OrderBy []Order
+		Offset  int
+	}
+
+	// Order sorts the result of a walk
+	Order struct {
+		By OrderField
+		// Path inside the attributes, used by OrderByToAttribute
+		// and OrderByAttribute
+		Path []string
+		Desc bool
+	}
+
+	// OrderField is what an Order uses to sort
+	OrderField int
+
+	// UpsertMode controls what UpsertNode does with the attributes
+	// of a node that already exists
+	UpsertMode int
+
 	dbWrap struct {
-		sql.DB
+		*sql.DB
 	}
 
 	scanner interface {
@@ -97,20 +187,120 @@ var (
 		`create table if not exists nodes (gid bigserial,
 			name text not null constraint unq_name_cannot_repeat unique,
 			attributes json, primary key (gid))`,
-		`create table if not exists relations (field int not null, attributes json, from_ bigint not null, to_ bigint not null, primary key (from_, to_, field),
+		`create table if not exists keywords ( kid serial primary key, name text not null constraint unq_keyword_name unique)`,
+		`create table if not exists relations (rid bigserial primary key, field int not null, attributes json, from_ bigint not null, to_ bigint not null,
+		multi boolean not null default false,
 		foreign key(from_) references nodes(gid),
-		foreign key(to_) references nodes(gid))`,
-		`create table if not exists keywords ( kid serial primary key, name text not null)`,
+		foreign key(to_) references nodes(gid),
+		constraint relations_field_fkey foreign key(field) references keywords(kid))`,
+		// databases created before relations had an id used (from_, to_, field) as the primary key
+		`do $$
+		begin
+			if not exists (select 1 from information_schema.columns
+				where table_schema = current_schema() and table_name = 'relations' and column_name = 'rid') then
+				alter table relations drop constraint relations_pkey;
+				alter table relations add column rid bigserial primary key;
+				alter table relations add column multi boolean not null default false;
+			end if;
+		end $$`,
+		// only relations created by a Multi rule can repeat
+		`create unique index if not exists unq_single_relation on relations(from_, to_, field) where not multi`,
+		`create index if not exists relations_by_from on relations(from_, field)`,
+		`create index if not exists relations_by_to on relations(to_, field)`,
+		// databases created before unq_keyword_name existed
+		`create unique index if not exists unq_keyword_name on keywords(name)`,
+		// databases created before relations.field referenced keywords
+		`do $$
+		begin
+			if not exists (select 1 from pg_constraint where conname = 'relations_field_fkey') then
+				alter table relations add constraint relations_field_fkey foreign key(field) references keywords(kid);
+			end if;
+		end $$`,
+		`create table if not exists relation_rules (kid int primary key references keywords(kid) on delete cascade,
+			cardinality int not null default 0, no_self_loops boolean not null default false,
+			from_pattern text not null default '', to_pattern text not null default '',
+			multi boolean not null default false)`,
+		`create table if not exists labels (gid bigint not null references nodes(gid), label text not null,
+			primary key (gid, label))`,
+		`create index if not exists labels_by_label on labels(label, gid)`,
+		`create table if not exists attribute_schemas (kind text not null, key text not null,
+			body text not null, primary key (kind, key))`,
+		// the change log is written by triggers, so deletes done by cascade
+		// or by name are recorded as well, see Changes
+		`create table if not exists changes (cid bigserial primary key,
+			tx bigint not null default txid_current(),
+			kind text not null, op text not null,
+			gid bigint, name text, rid bigint, from_ bigint, to_ bigint, field int,
+			at timestamptz not null default now())`,
+		`create index if not exists changes_by_tx on changes(tx, cid)`,
+		// the name of the relation when it was written, and the name before
+		// a keyword is renamed or removed
+		`alter table changes add column if not exists keyword text`,
+		`alter table changes add column if not exists old_keyword text`,
+		`create or replace function ograph_log_change() returns trigger as $$
+		declare
+			row_ record;
+		begin
+			if tg_op = 'DELETE' then
+				row_ := old;
+			else
+				row_ := new;
+			end if;
+			if tg_table_name = 'nodes' then
+				insert into changes(kind, op, gid, name) values ('node', lower(tg_op), row_.gid, row_.name);
+			elsif tg_table_name = 'relations' then
+				insert into changes(kind, op, rid, from_, to_, field, keyword)
+					values ('relation', lower(tg_op), row_.rid, row_.from_, row_.to_, row_.field,
+						(select kw.name from keywords kw where kw.kid = row_.field));
+			else
+				-- a renamed or removed keyword, row_ is the new row of an update
+				insert into changes(kind, op, field, keyword, old_keyword)
+					values ('keyword', lower(tg_op), old.kid,
+						case when tg_op = 'UPDATE' then row_.name end, old.name);
+			end if;
+			-- delivered on commit, see Subscribe
+			perform pg_notify('ograph_changes', '');
+			return null;
+		end $$ language plpgsql`,
+		// the triggers are only created once, so there is never a moment without
+		// them; the replaced ograph_log_change is used by the existing ones
+		`do $$
+		begin
+			if not exists (select 1 from pg_trigger
+				where tgname = 'log_node_changes' and tgrelid = 'nodes'::regclass) then
+				create trigger log_node_changes after insert or update or delete on nodes
+					for each row execute procedure ograph_log_change();
+			end if;
+			if not exists (select 1 from pg_trigger
+				where tgname = 'log_relation_changes' and tgrelid = 'relations'::regclass) then
+				create trigger log_relation_changes after insert or update or delete on relations
+					for each row execute procedure ograph_log_change();
+			end if;
+			if not exists (select 1 from pg_trigger
+				where tgname = 'log_keyword_changes' and tgrelid = 'keywords'::regclass) then
+				create trigger log_keyword_changes after update of name or delete on keywords
+					for each row execute procedure ograph_log_change();
+			end if;
+		exception when duplicate_object then
+			-- created by a concurrent Create
+			null;
+		end $$`,
 	}
 
 	sqlDrop = []string{
 		`drop table if exists relations`,
+		`drop table if exists relation_rules`,
+		`drop table if exists labels`,
 		`drop table if exists nodes`,
 		`drop table if exists keywords`,
+		`drop table if exists attribute_schemas`,
+		`drop table if exists changes`,
+		`drop function if exists ograph_log_change()`,
 	}
 
 	sqlDelete = []string {
 		`delete from relations`,
+		`delete from labels`,
 		`delete from nodes`,
 	}
 )
@@ -118,26 +308,87 @@ var (
 const (
 	selectKeywordByGid      = `select kid, name from keywords where kid = $1`
 	selectKeywordByName = `select kid, name from keywords where name = $1`
-	insertKeyword      = `insert into keywords(name) values ($1) returning kid`
-	selectNodeByGid    = `select gid, name, attributes from nodes where gid = $1`
-	selectNodeByNameEq = `select gid, name, attributes from nodes where name = $1`
+	selectAllKeywords  = `select kid, name from keywords`
+	// nothing is returned when another transaction inserted the name first
+	insertKeyword      = `insert into keywords(name) values ($1) on conflict (name) do nothing returning kid`
+	// keeps the keyword from being renamed or removed until the transaction ends
+	lockKeyword        = `select kid from keywords where kid = $1 and name = $2 for share`
+	renameKeyword      = `update keywords set name = $2 where name = $1 returning kid`
+	deleteUnusedKeyword = `delete from keywords kw where kw.name = $1
+		and not exists (select 1 from relations r where r.field = kw.kid)
+		returning kid`
+	selectKeywordUsage = `select kw.kid, kw.name, count(r.field)
+		from keywords kw
+			left join relations r
+				on r.field = kw.kid
+		group by kw.kid, kw.name
+		order by kw.name`
+	selectNodeByGid    = `select n.gid, n.name, n.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = n.gid)
+		from nodes n where n.gid = $1`
+	selectNodeByNameEq = `select n.gid, n.name, n.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = n.gid)
+		from nodes n where n.name = $1`
+	selectNodesByGid = `select n.gid, n.name, n.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = n.gid)
+		from nodes n where n.gid = any($1)`
+	selectNodesByName = `select n.gid, n.name, n.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = n.gid)
+		from nodes n where n.name = any($1)`
 	insertNode         = `insert into nodes(name, attributes) values ($1, $2) returning gid`
 	updateNode         = `update nodes set attributes = $2 where gid = $1 returning name`
-	insertRelation     = `insert into relations (from_, to_, field, attributes) values ($1, $2, $3, $4)`
-	updateRelation     = `update relations set attributes = $4 where from_ = $1 and to_ = $2 and field = $3`
+	// nothing is returned when the node exists, it is read by selectNodeKeep
+	// so the existing row isn't locked or rewritten
+	upsertNodeKeep     = `insert into nodes(name, attributes) values ($1, $2)
+		on conflict (name) do nothing
+		returning gid, attributes`
+	selectNodeKeep  = `select gid, attributes from nodes where name = $1`
+	upsertNodeMerge = `insert into nodes(name, attributes) values ($1, $2)
+		on conflict (name) do update set attributes = (coalesce(nodes.attributes::jsonb, '{}'::jsonb) || excluded.attributes::jsonb)::json
+		returning gid, attributes`
+	upsertNodeReplace = `insert into nodes(name, attributes) values ($1, $2)
+		on conflict (name) do update set attributes = excluded.attributes
+		returning gid, attributes`
+	insertRelation     = `insert into relations (from_, to_, field, attributes, multi) values ($1, $2, $3, $4, $5) returning rid`
+	updateRelation     = `update relations set attributes = $4 where from_ = $1 and to_ = $2 and field = $3 and not multi returning rid`
+	updateRelationByRid = `update relations set attributes = $5 where rid = $1 and from_ = $2 and to_ = $3 and field = $4`
 	selectRelation = `select f.gid, f.name, f.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = f.gid),
 		t.gid, t.name, t.attributes,
-		r.field, kw.name, r.attributes
+		(select array_agg(l.label order by l.label) from labels l where l.gid = t.gid),
+		r.field, kw.name, r.attributes, r.rid
 		from relations r
 			inner join keywords kw
 				on kw.kid = $3 and r.field = kw.kid
 			inner join nodes f
 				on f.gid = $1 and r.from_ = f.gid
 			inner join nodes t
-				on t.gid = $2 and r.to_ = t.gid`
+				on t.gid = $2 and r.to_ = t.gid
+		order by r.rid
+		limit 1`
+	selectRelationByRid = `select f.gid, f.name, f.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = f.gid),
+		t.gid, t.name, t.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = t.gid),
+		r.field, kw.name, r.attributes, r.rid
+		from relations r
+			inner join keywords kw
+				on r.field = kw.kid
+			inner join nodes f
+				on r.from_ = f.gid
+			inner join nodes t
+				on r.to_ = t.gid
+		where r.rid = $1`
+	deleteRelationByRid = `delete from relations where rid = $1`
+	deleteNodeRelations = `delete from relations where from_ = $1 or to_ = $1`
+	deleteNodeLabels    = `delete from labels where gid = $1`
+	deleteNode          = `delete from nodes where gid = $1`
+	deleteRelations     = `delete from relations where from_ = $1 and to_ = $2 and field = $3`
 	selectRelationWalk = `select f.gid, f.name, f.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = f.gid),
 		t.gid, t.name, t.attributes,
-		r.field, kw.name, r.attributes
+		(select array_agg(l.label order by l.label) from labels l where l.gid = t.gid),
+		r.field, kw.name, r.attributes, r.rid
 		from relations r
 			inner join nodes f
 				on f.gid = $1 and r.from_ = f.gid
@@ -148,18 +399,46 @@ const (
 
 	InvalidGid = uint64(0)
 	InvalidKid = uint32(0)
+	InvalidRid = uint64(0)
+)
+
+var (
+	ErrKeywordNotFound = errors.New("keyword not found")
+	ErrKeywordExists   = errors.New("keyword already exists")
+	ErrKeywordInUse    = errors.New("keyword is used by at least one relation")
+)
+
+const (
+	// OrderByToName sorts by the name of the target node
+	OrderByToName = OrderField(iota)
+	// OrderByToAttribute sorts by an attribute of the target node
+	OrderByToAttribute
+	// OrderByAttribute sorts by an attribute of the relation
+	OrderByAttribute
+)
+
+const (
+	// UpsertKeep leaves the attributes of an existing node untouched
+	UpsertKeep = UpsertMode(iota)
+	// UpsertMerge adds the new top-level attributes to the existing ones,
+	// overwriting the keys present in both
+	UpsertMerge
+	// UpsertReplace discards the existing attributes
+	UpsertReplace
 )
 
 func (r *Relation) CopyFromData(n *Node) {
 	r.FromGid = n.Gid
 	r.FromName = n.Name
 	r.FromAttributes = n.Attributes
+	r.FromLabels = n.Labels
 }
 
 func (r *Relation) CopyToData(n *Node) {
 	r.ToGid = n.Gid
 	r.ToName = n.Name
 	r.ToAttributes = n.Attributes
+	r.ToLabels = n.Labels
 }
 
 func (r *Relation) Set(subject *Node, object string, predicate *Node) *Relation {
@@ -169,9 +448,10 @@ func (r *Relation) Set(subject *Node, object string, predicate *Node) *Relation
 	return r
 }
 func (nr *Repo) Create() error {
+	nr.closeStatements()
 	var firstError error
 	for _, cmd := range sqlCreateTables {
-		_, err := nr.Db.Exec(cmd)
+		_, err := nr.execOn(nr.Db, cmd)
 		if err != nil {
 			// continue but keep the first error
 			firstError = err
@@ -182,14 +462,16 @@ func (nr *Repo) Create() error {
 }
 
 func (nr *Repo) Drop() error {
+	nr.closeStatements()
 	var firstError error
 	for _, cmd := range sqlDrop {
-		_, err := nr.Db.Exec(cmd)
+		_, err := nr.execOn(nr.Db, cmd)
 		if err != nil {
 			// continue but keep the first error
 			firstError = err
 		}
 	}
+	nr.keywordCache().Reset()
 	if firstError == nil {
 		firstError = nr.Create()
 	}
@@ -198,11 +480,11 @@ func (nr *Repo) Drop() error {
 }
 
 // DeleteAll remove all nodes and relations from the database but keep
-// all keywords
+// all keywords and the change log, which records the deletes
 func (nr *Repo) DeleteAll() error {
 	var firstError error
 	for _, cmd := range sqlDelete {
-		_, err := nr.Db.Exec(cmd)
+		_, err := nr.execOn(nr.Db, cmd)
 		if err != nil {
 			// continue but keep the first error
 			firstError = err
@@ -217,22 +499,71 @@ func (nr *Repo) DeleteAll() error {
 
 func (nr *Repo) Connect(user, password, dbname, host string) error {
 	var sqldb *sql.DB
-	sqldb, nr.err = sql.Open("postgres", fmt.Sprintf("user=%v dbname=%v password=%v host=%v sslmode=disable", user, dbname, password, host))
-	nr.Db = &dbWrap{*sqldb}
+	nr.dsn = fmt.Sprintf("user=%v dbname=%v password=%v host=%v sslmode=disable", user, dbname, password, host)
+	sqldb, nr.err = sql.Open("postgres", nr.dsn)
+	if nr.err != nil {
+		return nr.err
+	}
+	nr.Db = &dbWrap{sqldb}
+	if nr.Keywords == nil {
+		nr.Keywords = NewKeywordCache()
+	}
+	if err := nr.LoadKeywords(); err != nil && !isUndefinedTable(err) {
+		// a missing table is fine, Create wasn't called yet
+		nr.err = err
+	}
 	return nr.err
 }
 
+func isUndefinedTable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "42P01"
+}
+
 func (nr *Repo) FetchNode(name string, gid uint64, out *Node) error {
-	querier := nr.ActiveQuerier()
 	var err error
 	if gid != 0 {
-		err = querier.QueryRow(selectNodeByGid, gid).Scan(&out.Gid, &out.Name, &out.Attributes)
+		err = scanNode(nr.queryRow(selectNodeByGid, gid), out)
 	} else {
-		err = querier.QueryRow(selectNodeByNameEq, name).Scan(&out.Gid, &out.Name, &out.Attributes)
+		err = scanNode(nr.queryRow(selectNodeByNameEq, name), out)
 	}
 	return err
 }
 
+// FetchNodes reads all nodes in gids with a single query, the
+// order of the result is undefined and missing nodes are ignored
+func (nr *Repo) FetchNodes(gids []uint64) ([]Node, error) {
+	if nr.err != nil {
+		return nil, nr.err
+	}
+	ids := make([]int64, len(gids))
+	for i, gid := range gids {
+		ids[i] = int64(gid)
+	}
+	return nr.queryNodes(selectNodesByGid, pq.Array(ids))
+}
+
+// FetchNodesByName works like FetchNodes but using the names of the nodes
+func (nr *Repo) FetchNodesByName(names []string) ([]Node, error) {
+	if nr.err != nil {
+		return nil, nr.err
+	}
+	return nr.queryNodes(selectNodesByName, pq.Array(names))
+}
+
+func (nr *Repo) queryNodes(query string, args ...interface{}) ([]Node, error) {
+	var out []Node
+	nr.err = nr.each(query, args, func(rows *sql.Rows) error {
+		var n Node
+		if err := scanNode(rows, &n); err != nil {
+			return err
+		}
+		out = append(out, n)
+		return nil
+	})
+	return out, nr.err
+}
+
 func (nr *Repo) SaveNode(node *Node) error {
 	if !nr.Begin() {
 		return nr.err
@@ -242,11 +573,55 @@ func (nr *Repo) SaveNode(node *Node) error {
 	}
 	if node.Gid == 0 {
 		// insert
-		nr.err = nr.Transaction.QueryRow(insertNode, node.Name, node.Attributes).Scan(&node.Gid)
+		nr.err = nr.queryRow(insertNode, node.Name, node.Attributes).Scan(&node.Gid)
+		if nr.err == nil && node.Labels != nil {
+			nr.err = nr.replaceLabels(node)
+		}
 	} else {
 		// update
-		_, nr.err = nr.Transaction.Exec(updateNode, node.Gid, node.Attributes)
+		_, nr.err = nr.exec(updateNode, node.Gid, node.Attributes)
+		if nr.err == nil {
+			nr.err = nr.replaceLabels(node)
+		}
 	}
+	nr.Metrics.nodeWrite("save", nr.err)
+	return nr.err
+}
+
+// UpsertNode inserts the node or, if a node with the same name already exists,
+// reuses it. node.Gid and node.Attributes are updated with the stored values.
+func (nr *Repo) UpsertNode(node *Node, mode UpsertMode) error {
+	if !nr.Begin() {
+		return nr.err
+	}
+	if len(node.Attributes) == 0 {
+		node.Attributes = "{}"
+	}
+	var query string
+	switch mode {
+	case UpsertKeep:
+		query = upsertNodeKeep
+	case UpsertMerge:
+		query = upsertNodeMerge
+	case UpsertReplace:
+		query = upsertNodeReplace
+	default:
+		nr.err = fmt.Errorf("invalid upsert mode: %v", mode)
+		return nr.err
+	}
+	nr.err = nr.queryRow(query, node.Name, node.Attributes).Scan(&node.Gid, &node.Attributes)
+	if nr.err == sql.ErrNoRows && mode == UpsertKeep {
+		nr.err = nr.queryRow(selectNodeKeep, node.Name).Scan(&node.Gid, &node.Attributes)
+	}
+	if nr.err != nil {
+		return nr.err
+	}
+	if mode == UpsertReplace {
+		nr.err = nr.replaceLabels(node)
+	} else {
+		nr.err = nr.addLabels(node)
+	}
+	nr.Metrics.nodeWrite("upsert", nr.err)
 	return nr.err
 }
 
@@ -254,14 +629,27 @@ func (nr *Repo) Keyword(id interface{}, out *Keyword) error {
 	if nr.err != nil {
 		return nr.err
 	}
-	querier := nr.ActiveQuerier()
+	if nr.cachedKeyword(id, out) {
+		nr.Metrics.keywordLookup("cache")
+		return nil
+	}
 	switch id := id.(type) {
 	case uint32:
-		nr.err = querier.QueryRow(selectKeywordByGid, id).Scan(&out.Gid, &out.Name)
+		nr.err = nr.queryRow(selectKeywordByGid, id).Scan(&out.Gid, &out.Name)
 	case string:
-		nr.err = querier.QueryRow(selectKeywordByName, id).Scan(&out.Gid, &out.Name)
+		nr.err = nr.queryRow(selectKeywordByName, id).Scan(&out.Gid, &out.Name)
 	default:
-		fmt.Errorf("cannot use %#v as keyword identification", id)
+		nr.err = fmt.Errorf("cannot use %#v as keyword identification", id)
+	}
+	switch nr.err {
+	case nil:
+		nr.cacheKeyword(*out)
+		nr.Metrics.keywordLookup("database")
+	case sql.ErrNoRows:
+		nr.Metrics.keywordLookup("missing")
+		// a missing keyword doesn't break the active transaction
+		nr.err = nil
+		return sql.ErrNoRows
 	}
 	return nr.err
 }
@@ -275,10 +663,24 @@ func (nr *Repo) SaveKeyword(kw *Keyword) error {
 		return nr.err
 	}
 	// try to check if the keyword already exists
-	nr.err = nr.Transaction.QueryRow(selectKeywordByName, kw.Name).Scan(&kw.Gid, &kw.Name)
+	if nr.cachedKeyword(kw.Name, kw) {
+		return nil
+	}
+	nr.err = nr.queryRow(selectKeywordByName, kw.Name).Scan(&kw.Gid, &kw.Name)
 	if nr.err == sql.ErrNoRows {
-		nr.err = nil
-		nr.err = nr.Transaction.QueryRow(insertKeyword, kw.Name).Scan(&kw.Gid)
+		nr.err = nr.queryRow(insertKeyword, kw.Name).Scan(&kw.Gid)
+		if nr.err == nil {
+			nr.pendingKeywords = append(nr.pendingKeywords, *kw)
+			return nil
+		}
+		if nr.err != sql.ErrNoRows {
+			return nr.err
+		}
+		// inserted by a concurrent transaction, which committed it
+		nr.err = nr.queryRow(selectKeywordByName, kw.Name).Scan(&kw.Gid, &kw.Name)
+	}
+	if nr.err == nil {
+		nr.cacheKeyword(*kw)
 	}
 	return nr.err
 }
@@ -293,119 +695,282 @@ func (r *Repo) SaveRelation(rel *Relation) error {
 	if !r.Begin() {
 		return r.err
 	}
+	defer func() { r.Metrics.relationWrite("save", r.err) }()
 	if len(rel.Attributes) == 0 {
 		rel.Attributes = "{}"
 	}
 
 	// read the keyword
 	var kw Keyword
-	if r.err = r.Keyword(rel.Name, &kw); r.err != nil {
-		if r.err == sql.ErrNoRows {
-			// try to insert
-			r.err = nil
-			kw.Name = rel.Name
-			r.err = r.SaveKeyword(&kw)
-		}
-	}
-	if r.err != nil {
+	if r.err = r.relationKeyword(rel.Name, &kw); r.err != nil {
 		// abort here
 		return r.err
 	}
 	rel.Field = kw.Gid
 	rel.Name = kw.Name
-	// if we are here, kw holds the kid
-	activeQuerier := r.ActiveQuerier()
-	var result sql.Result
-	if result, r.err = activeQuerier.Exec(updateRelation, rel.FromGid, rel.ToGid, rel.Field, rel.Attributes); r.err != nil {
-		// abort here
+	var rule RelationRule
+	if _, r.err = r.fetchRelationRule(rel.Field, &rule); r.err != nil {
 		return r.err
 	}
-	var affected int64
-	// check if the result means that no row was updated
-	if affected, r.err = result.RowsAffected(); r.err != nil {
-		// abort here
+	if r.err = r.checkRelationRule(rel, &rule); r.err != nil {
 		return r.err
 	}
-
-	if affected > 0 {
-		// done and okay
-		return nil
+	// if we are here, kw holds the kid
+	if rel.Rid != InvalidRid {
+		// update a known relation
+		var result sql.Result
+		if result, r.err = r.exec(updateRelationByRid, rel.Rid, rel.FromGid, rel.ToGid, rel.Field, rel.Attributes); r.err != nil {
+			return r.err
+		}
+		var affected int64
+		if affected, r.err = result.RowsAffected(); r.err == nil && affected == 0 {
+			r.err = fmt.Errorf("relation %v with name %q from %v to %v not found", rel.Rid, rel.Name, rel.FromGid, rel.ToGid)
+		}
+		return r.err
+	}
+	if !rule.Multi {
+		r.err = r.queryRow(updateRelation, rel.FromGid, rel.ToGid, rel.Field, rel.Attributes).Scan(&rel.Rid)
+		if r.err != sql.ErrNoRows {
+			// either updated or failed
+			return r.err
+		}
+		r.err = nil
 	}
 	// insert
-	_, r.err = activeQuerier.Exec(insertRelation, rel.FromGid, rel.ToGid, rel.Field, rel.Attributes);
+	r.err = r.queryRow(insertRelation, rel.FromGid, rel.ToGid, rel.Field, rel.Attributes, rule.Multi).Scan(&rel.Rid)
 	return r.err
 }
 
 func (r *Repo) Walk(from uint64, name string, out RelationSet) (RelationSet, error) {
+	return r.WalkWith(from, name, nil, out)
+}
+
+// WalkWith works like Walk but only returns the relations allowed by opts,
+// a nil opts returns everything
+func (r *Repo) WalkWith(from uint64, name string, opts *WalkOptions, out RelationSet) (RelationSet, error) {
 	if r.err != nil {
 		return out, r.err
 	}
-	var kw Keyword
-	if err := r.Keyword(name, &kw); err != nil {
-		return nil, err
-	}
-	activeQuerier := r.ActiveQuerier()
 	if out == nil {
 		out = make(RelationSet, 0)
 	}
+	err := r.WalkEach(from, name, opts, func(rel *Relation) error {
+		out.Push(rel)
+		return nil
+	})
+	return out, err
+}
 
-	rows, err := activeQuerier.Query(selectRelationWalk, from, kw.Gid)
+// WalkEach calls fn for each relation as the rows are read from the database,
+// without keeping them in memory. An error from fn stops the walk and is returned.
+func (r *Repo) WalkEach(from uint64, name string, opts *WalkOptions, fn func(*Relation) error) error {
+	if r.err != nil {
+		return r.err
+	}
+	var kw Keyword
+	if err := r.Keyword(name, &kw); err != nil {
+		return err
+	}
+	query, args, err := walkQuery(from, kw.Gid, opts)
 	if err != nil {
-		r.err = err
-		return out, err
+		return err
 	}
-	for rows.Next() {
-		var rel Relation
-		r.err = scanRelation(rows, &rel)
-		if r.err != nil {
-			break
+	started, count := time.Now(), 0
+	err = r.eachRow(query, args, func(rows *sql.Rows) error {
+		rel := &Relation{}
+		if r.err = scanRelation(rows, rel); r.err != nil {
+			return r.err
 		}
-		out.Push(&rel)
+		count++
+		return fn(rel)
+	})
+	r.Metrics.walk(count, started)
+	return err
+}
+
+// QueryEach runs a read only query and calls fn for each row,
+// used to run queries generated by other packages
+func (r *Repo) QueryEach(query string, args []interface{}, fn func(*sql.Rows) error) error {
+	if r.err != nil {
+		return r.err
 	}
-	r.err = rows.Err()
-	return out, r.err
+	return r.eachRow(query, args, fn)
 }
 
+// FetchRelation reads the relation with the given name between two nodes,
+// sql.ErrNoRows is returned when it doesn't exist
 func (r *Repo) FetchRelation(from, to uint64, name string, out *Relation) error {
-	activeQuerier := r.ActiveQuerier()
 	if r.err != nil {
 		return r.err
 	}
 
-	var kw Keyword
-	if err := r.Keyword(name, &kw); err != nil {
+	kw, found, err := r.lookupKeyword(name)
+	if err != nil {
 		return err
 	}
+	if !found {
+		return sql.ErrNoRows
+	}
+
+	err = scanRelation(r.queryRow(selectRelation, from, to, kw.Gid), out)
+	if err != sql.ErrNoRows {
+		// a missing relation doesn't break the active transaction
+		r.err = err
+	}
+	return err
+}
 
-	r.err = scanRelation(activeQuerier.QueryRow(selectRelation, from, to, kw.Gid), out)
+// FetchRelationByRid reads the relation identified by rid
+func (r *Repo) FetchRelationByRid(rid uint64, out *Relation) error {
+	if r.err != nil {
+		return r.err
+	}
+	return scanRelation(r.queryRow(selectRelationByRid, rid), out)
+}
+
+// DeleteRelation removes the relation identified by rel.Rid or, when Rid
+// isn't set, every relation with rel.Name from rel.FromGid to rel.ToGid
+func (r *Repo) DeleteRelation(rel *Relation) error {
+	if !r.Begin() {
+		return r.err
+	}
+	defer func() { r.Metrics.relationWrite("delete", r.err) }()
+	if rel.Rid != InvalidRid {
+		_, r.err = r.exec(deleteRelationByRid, rel.Rid)
+		return r.err
+	}
+	var kw Keyword
+	if err := r.Keyword(rel.Name, &kw); err == sql.ErrNoRows {
+		// unknown name, nothing to remove
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, r.err = r.exec(deleteRelations, rel.FromGid, rel.ToGid, kw.Gid)
 	return r.err
 }
 
+// DeleteNode removes the node, its labels and every relation from or to it
+func (r *Repo) DeleteNode(gid uint64) error {
+	if !r.Begin() {
+		return r.err
+	}
+	defer func() { r.Metrics.nodeWrite("delete", r.err) }()
+	for _, cmd := range []string{deleteNodeRelations, deleteNodeLabels, deleteNode} {
+		if _, r.err = r.exec(cmd, gid); r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// walkQuery appends the filters from opts to selectRelationWalk
+func walkQuery(from uint64, kid uint32, opts *WalkOptions) (string, []interface{}, error) {
+	query := selectRelationWalk
+	args := []interface{}{from, kid}
+	if opts == nil {
+		return query, args, nil
+	}
+	if len(opts.OrderBy) > 0 && opts.After != InvalidRid {
+		return "", nil, errors.New("cannot use After with OrderBy, use Offset")
+	}
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	var where []string
+	if labels := normalizeLabels(opts.ToLabels); len(labels) > 0 {
+		where = append(where, fmt.Sprintf("(select count(*) from labels l where l.gid = t.gid and l.label = any(%v)) = %v",
+			param(pq.Array(labels)), param(len(labels))))
+	}
+	if opts.After != InvalidRid {
+		where = append(where, "r.rid > "+param(int64(opts.After)))
+	}
+	if len(where) > 0 {
+		query += "\n\t\twhere " + strings.Join(where, " and ")
+	}
+	var order []string
+	for _, o := range opts.OrderBy {
+		var expr string
+		switch o.By {
+		case OrderByToName:
+			expr = "t.name"
+		case OrderByToAttribute:
+			expr = fmt.Sprintf("(t.attributes::jsonb #> %v)", param(pq.Array(o.Path)))
+		case OrderByAttribute:
+			expr = fmt.Sprintf("(r.attributes::jsonb #> %v)", param(pq.Array(o.Path)))
+		default:
+			return "", nil, fmt.Errorf("invalid order: %v", o.By)
+		}
+		if o.Desc {
+			expr += " desc"
+		}
+		order = append(order, expr+" nulls last")
+	}
+	if len(order) > 0 || opts.Limit > 0 || opts.Offset > 0 || opts.After != InvalidRid {
+		order = append(order, "r.rid")
+		query += "\n\t\torder by " + strings.Join(order, ", ")
+	}
+	if opts.Limit > 0 {
+		query += "\n\t\tlimit " + param(opts.Limit)
+	}
+	if opts.Offset > 0 {
+		query += "\n\t\toffset " + param(opts.Offset)
+	}
+	return query, args, nil
+}
+
+func scanNode(sc scanner, out *Node) error {
+	return sc.Scan(&out.Gid, &out.Name, &out.Attributes, (*pq.StringArray)(&out.Labels))
+}
+
 func scanRelation(sc scanner, out *Relation) error {
-	return sc.Scan(&out.FromGid, &out.FromName, &out.FromAttributes,
-		&out.ToGid, &out.ToName, &out.ToAttributes,
-		&out.Field, &out.Name, &out.Attributes)
+	return sc.Scan(&out.FromGid, &out.FromName, &out.FromAttributes, (*pq.StringArray)(&out.FromLabels),
+		&out.ToGid, &out.ToName, &out.ToAttributes, (*pq.StringArray)(&out.ToLabels),
+		&out.Field, &out.Name, &out.Attributes, &out.Rid)
 }
 
 func (r *Repo) Begin() bool {
 	if r.err == nil && r.Transaction == nil {
+		r.endErr = nil
 		r.Transaction, r.err = r.Db.Begin()
+		r.txStarted = time.Now()
 	}
 	return r.err == nil
 }
 
-func (r *Repo) End() error {
+// End commits the active transaction or, when the Repo has an error, rolls
+// it back. The error is returned and Err keeps returning it until the next
+// Begin, but it doesn't stop the reads or the next transaction.
+func (r *Repo) End() (err error) {
+	err, r.err = r.err, nil
+	defer func() { r.endErr = err }()
 	if r.Transaction != nil {
 		defer func() {
 			r.Transaction = nil
+			r.endStatements()
 		}()
-		if r.err == nil {
-			return r.Transaction.Commit()
+		if err == nil {
+			err = r.Transaction.Commit()
+			r.flushKeywords(err == nil)
+			r.Metrics.transaction(err == nil, r.txStarted)
+			return err
 		} else {
-			return r.Transaction.Rollback()
+			r.flushKeywords(false)
+			r.Metrics.transaction(false, r.txStarted)
+			r.Transaction.Rollback()
 		}
 	}
-	return nil
+	return err
+}
+
+// Abort records err as the error of the active transaction, so End will
+// roll it back. The first error is kept.
+func (r *Repo) Abort(err error) error {
+	if r.err == nil {
+		r.err = err
+	}
+	return r.err
 }
 
 func (r *Repo) ActiveQuerier() Querier {
@@ -415,13 +980,22 @@ func (r *Repo) ActiveQuerier() Querier {
 	return r.Db
 }
 
+// Err returns the error of the active transaction or, between End and the
+// next Begin, the error returned by End
 func (r *Repo) Err() error {
+	if r.err == nil && r.Transaction == nil {
+		return r.endErr
+	}
 	return r.err
 }
 
 func (r *Repo) AbortPending() error {
 	if r.Transaction != nil {
+		r.flushKeywords(false)
 		err := r.Transaction.Rollback()
+		r.Metrics.transaction(false, r.txStarted)
+		r.Transaction = nil
+		r.endStatements()
 		if r.err == nil {
 			r.err = err
 		}
@@ -431,7 +1005,10 @@ func (r *Repo) AbortPending() error {
 }
 
 func (r *Repo) Close() error {
+	// the statements are closed below, no need to prepare them on the Db
+	r.unprepared = nil
 	r.err = r.AbortPending()
+	r.closeStatements()
 	err := r.Db.Close()
 	if r.err == nil {
 		r.err = nil
@@ -20,7 +20,12 @@
 package data
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -163,3 +168,267 @@ func TestInsertRelation(t *testing.T) {
 		}
 	}
 }
+
+func TestKeywordCacheRollback(t *testing.T) {
+	repo := mustCreateRepo(t)
+	defer repo.Close()
+
+	committed := Keyword{Name: "committed"}
+	repo.Begin()
+	if err := repo.SaveKeyword(&committed); err != nil {
+		t.Fatalf("error saving keyword: %v", err)
+	}
+	if repo.Keywords.Get(committed.Name, &Keyword{}) {
+		t.Fatalf("keyword should not be in the shared cache before the commit")
+	}
+	repo.End()
+	var cached Keyword
+	if !repo.Keywords.Get(committed.Name, &cached) || !reflect.DeepEqual(cached, committed) {
+		t.Fatalf("committed keyword should be in the cache. expecting %v got %v", committed, cached)
+	}
+
+	aborted := Keyword{Name: "aborted"}
+	repo.Begin()
+	if err := repo.SaveKeyword(&aborted); err != nil {
+		t.Fatalf("error saving keyword: %v", err)
+	}
+	// force the rollback
+	repo.Abort(errors.New("rollback"))
+	repo.End()
+	if repo.Keywords.Get(aborted.Name, &Keyword{}) {
+		t.Fatalf("keyword from a rolled back transaction should not be cached")
+	}
+	if err := repo.Err(); err == nil || err.Error() != "rollback" {
+		t.Fatalf("expecting the rollback error after End got %v", err)
+	}
+
+	// reading the renamed keyword must not cache the uncommitted name
+	repo.Begin()
+	if err := repo.RenameKeyword(committed.Name, "renamed"); err != nil {
+		t.Fatalf("error renaming keyword: %v", err)
+	}
+	if repo.Err() != nil {
+		t.Fatalf("a new transaction should not see the old error, got %v", repo.Err())
+	}
+	var renamed Keyword
+	if err := repo.Keyword("renamed", &renamed); err != nil || renamed.Gid != committed.Gid {
+		t.Fatalf("expecting %v got %v (%v)", committed.Gid, renamed, err)
+	}
+	repo.Abort(errors.New("rollback"))
+	repo.End()
+	if repo.Keywords.Get("renamed", &Keyword{}) || repo.Keywords.Get(committed.Gid, &Keyword{}) {
+		t.Fatalf("keyword renamed by a rolled back transaction should not be cached")
+	}
+}
+
+func TestKeywordChangedElsewhere(t *testing.T) {
+	repo := mustCreateRepo(t)
+	defer repo.Close()
+	// another process, with its own cache
+	other := &Repo{Db: repo.Db, Keywords: NewKeywordCache()}
+
+	repo.Begin()
+	neo, morpheus := Node{Name: "neo"}, Node{Name: "morpheus"}
+	repo.SaveNode(&neo)
+	repo.SaveNode(&morpheus)
+	first := Relation{FromGid: neo.Gid, ToGid: morpheus.Gid, Name: "knows"}
+	repo.SaveRelation(&first)
+	if err := repo.End(); err != nil {
+		t.Fatalf("error saving relation: %v", err)
+	}
+
+	other.Begin()
+	other.RenameKeyword("knows", "trusts")
+	if err := other.End(); err != nil {
+		t.Fatalf("error renaming keyword: %v", err)
+	}
+
+	// the cache of repo still maps knows to the renamed kid
+	repo.Begin()
+	second := Relation{FromGid: morpheus.Gid, ToGid: neo.Gid, Name: "knows"}
+	repo.SaveRelation(&second)
+	if err := repo.End(); err != nil {
+		t.Fatalf("error saving relation: %v", err)
+	}
+	if second.Field == first.Field {
+		t.Fatalf("expecting a new keyword for knows, got the renamed one %v", first.Field)
+	}
+
+	other.Begin()
+	other.DeleteKeyword("knows")
+	if err := other.End(); err != ErrKeywordInUse {
+		t.Fatalf("expecting %v got %v", ErrKeywordInUse, err)
+	}
+}
+
+func TestRuleConcurrency(t *testing.T) {
+	repo := mustCreateRepo(t)
+	defer repo.Close()
+	other := &Repo{Db: repo.Db, Keywords: repo.Keywords}
+
+	repo.Begin()
+	nodes := []Node{{Name: "neo"}, {Name: "metacortex"}, {Name: "sati"}}
+	for i := range nodes {
+		repo.SaveNode(&nodes[i])
+	}
+	repo.SaveRelationRule(&RelationRule{Name: "works_at", Cardinality: ManyToOne})
+	if err := repo.End(); err != nil {
+		t.Fatalf("error saving nodes: %v", err)
+	}
+
+	repo.Begin()
+	if err := repo.SaveRelation(&Relation{FromGid: nodes[0].Gid, ToGid: nodes[1].Gid, Name: "works_at"}); err != nil {
+		t.Fatalf("error saving relation: %v", err)
+	}
+	// the other transaction waits for the lock taken by the first one
+	done := make(chan error)
+	go func() {
+		other.Begin()
+		other.SaveRelation(&Relation{FromGid: nodes[0].Gid, ToGid: nodes[2].Gid, Name: "works_at"})
+		done <- other.End()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := repo.End(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if err := <-done; err == nil {
+		t.Fatalf("the second relation should break the rule")
+	} else if _, ok := err.(*RuleError); !ok {
+		t.Fatalf("expecting a *RuleError got %v", err)
+	}
+}
+
+func TestPreparedStatements(t *testing.T) {
+	repo := mustCreateRepo(t)
+	defer repo.Close()
+
+	for i := 0; i < 2; i++ {
+		repo.Begin()
+		node := Node{Name: fmt.Sprintf("node-%v", i)}
+		if err := repo.SaveNode(&node); err != nil {
+			t.Fatalf("error saving node: %v", err)
+		}
+		if repo.txStmts[insertNode] == nil {
+			t.Fatalf("insertNode should be prepared for the transaction")
+		}
+		if err := repo.End(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+	if len(repo.stmts) == 0 || repo.txStmts != nil {
+		t.Fatalf("statements should be kept after the transaction. got %v / %v", repo.stmts, repo.txStmts)
+	}
+
+	repo.Unprepared = true
+	var node Node
+	if err := repo.FetchNode("node-1", 0, &node); err != nil {
+		t.Fatalf("error reading unprepared: %v", err)
+	}
+	if _, ok := repo.stmts[selectNodeByNameEq]; ok {
+		t.Fatalf("statement should not be prepared")
+	}
+
+	// a transaction prepares its statements with its own connection
+	repo.Unprepared = false
+	repo.closeStatements()
+	repo.Db.(*dbWrap).SetMaxOpenConns(1)
+	done := make(chan error)
+	go func() {
+		repo.Begin()
+		repo.SaveNode(&Node{Name: "single-connection"})
+		done <- repo.End()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("error saving with a single connection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("saving with a single connection should not block")
+	}
+	if _, ok := repo.stmts[insertNode]; !ok {
+		t.Fatalf("insertNode should be prepared on the Db after the transaction")
+	}
+}
+
+type recordHook struct {
+	before []string
+	after  []Statement
+}
+
+func (h *recordHook) Before(st *Statement) {
+	h.before = append(h.before, st.SQL)
+}
+
+func (h *recordHook) After(st *Statement) {
+	h.after = append(h.after, *st)
+}
+
+func TestHooks(t *testing.T) {
+	repo := mustCreateRepo(t)
+	defer repo.Close()
+
+	hook := &recordHook{}
+	repo.Hooks = append(repo.Hooks, hook)
+	repo.Begin()
+	node := Node{Name: "neo"}
+	if err := repo.SaveNode(&node); err != nil {
+		t.Fatalf("error saving node: %v", err)
+	}
+	repo.End()
+
+	if len(hook.after) == 0 || len(hook.before) != len(hook.after) {
+		t.Fatalf("before and after should be called for every statement. got %v / %v", hook.before, hook.after)
+	}
+	insert := hook.after[0]
+	if insert.SQL != insertNode || insert.Call != "SaveNode" || insert.Args[0] != "neo" || insert.Err != nil {
+		t.Errorf("unexpected statement: %#v", insert)
+	}
+
+	// a failed statement reports its error
+	repo.Begin()
+	if err := repo.SaveNode(&Node{Name: "neo"}); err == nil {
+		t.Fatalf("duplicated name should fail")
+	}
+	repo.End()
+	if last := hook.after[len(hook.after)-1]; last.Err == nil {
+		t.Errorf("expecting an error got %#v", last)
+	}
+}
+
+func TestSlogHook(t *testing.T) {
+	var buf bytes.Buffer
+	hook := NewSlogHook(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	st := &Statement{Call: "FetchNode", SQL: selectNodeByGid, Args: []interface{}{1}, Exec: time.Millisecond, Rows: -1}
+	hook.Before(st)
+	hook.After(st)
+	out := buf.String()
+	for _, expected := range []string{"level=DEBUG", "call=FetchNode", "duration=1ms", "args=[1]"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expecting %v in %v", expected, out)
+		}
+	}
+
+	buf.Reset()
+	hook.HideArgs = true
+	st.Err = errors.New("broken")
+	hook.After(st)
+	out = buf.String()
+	if !strings.Contains(out, "level=ERROR") || !strings.Contains(out, "error=broken") || strings.Contains(out, "args=") {
+		t.Errorf("unexpected log: %v", out)
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	c := Cursor{Tx: 1042, Id: 7}
+	parsed, err := ParseCursor(c.String())
+	if err != nil || parsed != c {
+		t.Errorf("expecting %v got %v (%v)", c, parsed, err)
+	}
+	if parsed, err := ParseCursor(""); err != nil || parsed != (Cursor{}) {
+		t.Errorf("expecting the zero cursor got %v (%v)", parsed, err)
+	}
+	if _, err := ParseCursor("not a cursor"); err == nil {
+		t.Errorf("expecting an error")
+	}
+}
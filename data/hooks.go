@@ -0,0 +1,78 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"context"
+	"log/slog"
+)
+
+type (
+	// Hook observes the statements sent by a Repo, see Repo.Hooks.
+	//
+	// Before receives the Call, SQL and Args of the statement, After receives
+	// the same value with the timings, Rows and Err filled. The Statement
+	// is reused by both calls and must not be kept after After returns.
+	Hook interface {
+		Before(st *Statement)
+		After(st *Statement)
+	}
+
+	// SlogHook logs every statement after it runs
+	SlogHook struct {
+		// nil uses slog.Default()
+		Logger *slog.Logger
+		// Level of the statements that succeed, failures use slog.LevelError
+		Level slog.Level
+		// HideArgs omits the arguments, which can have sensitive data
+		HideArgs bool
+	}
+)
+
+// NewSlogHook logs the statements to logger with level debug
+func NewSlogHook(logger *slog.Logger) *SlogHook {
+	return &SlogHook{Logger: logger, Level: slog.LevelDebug}
+}
+
+// Before does nothing, statements are logged once they end
+func (h *SlogHook) Before(st *Statement) {}
+
+// After logs the statement
+func (h *SlogHook) After(st *Statement) {
+	logger := h.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attrs := []slog.Attr{
+		slog.String("call", st.Call),
+		slog.String("sql", st.SQL),
+		slog.Duration("duration", st.Total()),
+		slog.Int64("rows", st.Rows),
+	}
+	if !h.HideArgs {
+		attrs = append(attrs, slog.Any("args", st.Args))
+	}
+	level := h.Level
+	if st.Err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", st.Err.Error()))
+	}
+	logger.LogAttrs(context.Background(), level, "statement", attrs...)
+}
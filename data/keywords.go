@@ -0,0 +1,325 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"sync"
+)
+
+type (
+	// KeywordCache holds the mapping between keyword names and ids.
+	//
+	// It is safe for concurrent use and can be shared by many Repo values
+	// connected to the same database.
+	KeywordCache struct {
+		lock   sync.RWMutex
+		byName map[string]uint32
+		byId   map[uint32]string
+	}
+)
+
+// NewKeywordCache returns an empty cache
+func NewKeywordCache() *KeywordCache {
+	return &KeywordCache{
+		byName: make(map[string]uint32),
+		byId:   make(map[uint32]string),
+	}
+}
+
+// Get fills out with the keyword identified by id (a uint32 kid or a string name),
+// returns false if the keyword isn't in the cache
+func (c *KeywordCache) Get(id interface{}, out *Keyword) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	switch id := id.(type) {
+	case uint32:
+		name, ok := c.byId[id]
+		if ok {
+			out.Gid, out.Name = id, name
+		}
+		return ok
+	case string:
+		kid, ok := c.byName[id]
+		if ok {
+			out.Gid, out.Name = kid, id
+		}
+		return ok
+	}
+	return false
+}
+
+// Put adds the keyword to the cache
+func (c *KeywordCache) Put(kws ...Keyword) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, kw := range kws {
+		c.byName[kw.Name] = kw.Gid
+		c.byId[kw.Gid] = kw.Name
+	}
+}
+
+// Forget removes the keywords from the cache
+func (c *KeywordCache) Forget(kws ...Keyword) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, kw := range kws {
+		if c.byName[kw.Name] == kw.Gid {
+			delete(c.byName, kw.Name)
+		}
+		if c.byId[kw.Gid] == kw.Name {
+			delete(c.byId, kw.Gid)
+		}
+	}
+}
+
+// Reset removes everything from the cache
+func (c *KeywordCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.byName = make(map[string]uint32)
+	c.byId = make(map[uint32]string)
+}
+
+// pendingKeyword search the keywords created by the active transaction
+func (r *Repo) pendingKeyword(id interface{}, out *Keyword) bool {
+	for _, kw := range r.pendingKeywords {
+		if kw.Gid == id || kw.Name == id {
+			*out = kw
+			return true
+		}
+	}
+	return false
+}
+
+// cachedKeyword search the keywords created by the active transaction and
+// then the ones already committed
+func (r *Repo) cachedKeyword(id interface{}, out *Keyword) bool {
+	if r.pendingKeyword(id, out) {
+		return true
+	}
+	for _, kw := range r.forgottenKeywords {
+		if kw.Gid == id || kw.Name == id {
+			// changed by this transaction, the cache might be stale
+			return false
+		}
+	}
+	return r.keywordCache().Get(id, out)
+}
+
+// forgetKeyword removes kw from the cache now and again after the commit,
+// since other Repo values could cache it before the transaction ends
+func (r *Repo) forgetKeyword(kw Keyword) {
+	pending := r.pendingKeywords[:0]
+	for _, p := range r.pendingKeywords {
+		if p.Gid != kw.Gid {
+			pending = append(pending, p)
+		}
+	}
+	r.pendingKeywords = pending
+	r.forgottenKeywords = append(r.forgottenKeywords, kw)
+	r.keywordCache().Forget(kw)
+}
+
+// flushKeywords moves the keywords created by a committed transaction
+// to the shared cache, or discard them if the transaction was rolled back
+func (r *Repo) flushKeywords(committed bool) {
+	if committed && len(r.forgottenKeywords) > 0 {
+		r.keywordCache().Forget(r.forgottenKeywords...)
+	}
+	if committed && len(r.pendingKeywords) > 0 {
+		r.keywordCache().Put(r.pendingKeywords...)
+	}
+	r.pendingKeywords = nil
+	r.forgottenKeywords = nil
+}
+
+// cacheKeyword adds a keyword read from the database to the shared cache.
+// Nothing is cached while the active transaction has created, renamed or
+// removed keywords, since the row could be one of its uncommitted changes.
+func (r *Repo) cacheKeyword(kw Keyword) {
+	if len(r.pendingKeywords) > 0 || len(r.forgottenKeywords) > 0 {
+		return
+	}
+	r.keywordCache().Put(kw)
+}
+
+// relationKeyword finds or creates the keyword of a relation and locks it
+// until the transaction ends. Another process could have renamed or removed
+// a cached keyword, in that case it is read again.
+func (r *Repo) relationKeyword(name string, kw *Keyword) error {
+	for attempt := 0; ; attempt++ {
+		err := r.Keyword(name, kw)
+		if err == sql.ErrNoRows {
+			*kw = Keyword{Name: name}
+			return r.SaveKeyword(kw)
+		} else if err != nil {
+			return err
+		}
+		if r.pendingKeyword(kw.Gid, kw) {
+			// created by this transaction
+			return nil
+		}
+		err = r.queryRow(lockKeyword, kw.Gid, kw.Name).Scan(&kw.Gid)
+		if err != sql.ErrNoRows {
+			return err
+		}
+		if attempt > 0 {
+			return errors.New("keyword " + name + " changed by a concurrent transaction")
+		}
+		// renamed or removed by another process
+		r.keywordCache().Forget(*kw)
+	}
+}
+
+func (r *Repo) keywordCache() *KeywordCache {
+	if r.Keywords == nil {
+		r.Keywords = NewKeywordCache()
+	}
+	return r.Keywords
+}
+
+// lookupKeyword finds a keyword by name, unlike Keyword a missing keyword
+// isn't an error
+func (r *Repo) lookupKeyword(name string) (Keyword, bool, error) {
+	var kw Keyword
+	if r.cachedKeyword(name, &kw) {
+		r.Metrics.keywordLookup("cache")
+		return kw, true, nil
+	}
+	err := r.queryRow(selectKeywordByName, name).Scan(&kw.Gid, &kw.Name)
+	switch err {
+	case nil:
+		r.cacheKeyword(kw)
+		r.Metrics.keywordLookup("database")
+		return kw, true, nil
+	case sql.ErrNoRows:
+		r.Metrics.keywordLookup("missing")
+		return kw, false, nil
+	}
+	return kw, false, err
+}
+
+// LoadKeywords reads all keywords from the database into the cache
+func (r *Repo) LoadKeywords() error {
+	if r.err != nil {
+		return r.err
+	}
+	var all []Keyword
+	err := r.each(selectAllKeywords, nil, func(rows *sql.Rows) error {
+		var kw Keyword
+		if err := rows.Scan(&kw.Gid, &kw.Name); err != nil {
+			return err
+		}
+		all = append(all, kw)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(r.pendingKeywords) == 0 && len(r.forgottenKeywords) == 0 {
+		r.keywordCache().Put(all...)
+	}
+	return nil
+}
+
+// KeywordUsage returns all keywords and how many relations use each one
+func (r *Repo) KeywordUsage() ([]KeywordUsage, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var out []KeywordUsage
+	r.err = r.each(selectKeywordUsage, nil, func(rows *sql.Rows) error {
+		var ku KeywordUsage
+		if err := rows.Scan(&ku.Gid, &ku.Name, &ku.Count); err != nil {
+			return err
+		}
+		out = append(out, ku)
+		return nil
+	})
+	return out, r.err
+}
+
+// RenameKeyword changes the name of a keyword, every relation using it
+// is renamed as well and so is its RelationSchema
+func (r *Repo) RenameKeyword(from, to string) error {
+	if !r.Begin() {
+		return r.err
+	}
+	if len(to) == 0 {
+		r.err = errors.New("cannot rename to an empty keyword")
+		return r.err
+	}
+	kw := Keyword{Name: from}
+	r.err = r.queryRow(renameKeyword, from, to).Scan(&kw.Gid)
+	switch {
+	case r.err == sql.ErrNoRows:
+		r.err = ErrKeywordNotFound
+	case isUniqueViolation(r.err):
+		r.err = ErrKeywordExists
+	case r.err == nil:
+		r.forgetKeyword(kw)
+		// the schema of a name without relations is replaced
+		if _, r.err = r.exec(deleteSchema, RelationSchema, to); r.err == nil {
+			_, r.err = r.exec(renameSchema, RelationSchema, from, to)
+		}
+	}
+	return r.err
+}
+
+// DeleteKeyword removes a keyword that isn't used by any relation,
+// with its RelationSchema
+func (r *Repo) DeleteKeyword(name string) error {
+	if !r.Begin() {
+		return r.err
+	}
+	kw := Keyword{Name: name}
+	r.err = r.queryRow(deleteUnusedKeyword, name).Scan(&kw.Gid)
+	if r.err == sql.ErrNoRows {
+		// either it doesn't exist or there are relations using it
+		r.err = r.queryRow(selectKeywordByName, name).Scan(&kw.Gid, &kw.Name)
+		if r.err == sql.ErrNoRows {
+			r.err = ErrKeywordNotFound
+		} else if r.err == nil {
+			r.err = ErrKeywordInUse
+		}
+		return r.err
+	}
+	if isForeignKeyViolation(r.err) {
+		// a relation using it was written by a concurrent transaction
+		r.err = ErrKeywordInUse
+	} else if r.err == nil {
+		r.forgetKeyword(kw)
+		_, r.err = r.exec(deleteSchema, RelationSchema, name)
+	}
+	return r.err
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23503"
+}
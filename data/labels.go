@@ -0,0 +1,113 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"sort"
+)
+
+const (
+	deleteOtherLabels = `delete from labels where gid = $1 and not (label = any($2))`
+	insertLabels      = `insert into labels(gid, label) select $1, unnest($2::text[])
+		on conflict do nothing`
+	selectNodeLabels = `select label from labels where gid = $1 order by label`
+	selectNodesWithLabels = `select n.gid, n.name, n.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = n.gid)
+		from nodes n
+		where n.gid in (select gid from labels where label = any($1) group by gid having count(*) = $2)
+		order by n.gid`
+)
+
+// normalizeLabels returns the labels sorted and without duplicates,
+// or nil if there isn't any label
+func normalizeLabels(labels []string) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := append([]string(nil), labels...)
+	sort.Strings(out)
+	uniq := out[:1]
+	for _, l := range out[1:] {
+		if l != uniq[len(uniq)-1] {
+			uniq = append(uniq, l)
+		}
+	}
+	return uniq
+}
+
+// replaceLabels makes node.Labels the only labels of the node. A nil Labels
+// keeps the stored ones, which are read into node.Labels, and an empty
+// slice removes them.
+func (nr *Repo) replaceLabels(node *Node) error {
+	if node.Labels == nil {
+		return nr.loadLabels(node)
+	}
+	node.Labels = normalizeLabels(node.Labels)
+	labels := pq.Array(node.Labels)
+	if node.Labels == nil {
+		labels = pq.Array([]string{})
+	}
+	if _, err := nr.exec(deleteOtherLabels, node.Gid, labels); err != nil {
+		return err
+	}
+	if node.Labels == nil {
+		return nil
+	}
+	_, err := nr.exec(insertLabels, node.Gid, labels)
+	return err
+}
+
+// addLabels adds node.Labels to the labels the node already has,
+// node.Labels is updated with the result
+func (nr *Repo) addLabels(node *Node) error {
+	if labels := normalizeLabels(node.Labels); labels != nil {
+		if _, err := nr.exec(insertLabels, node.Gid, pq.Array(labels)); err != nil {
+			return err
+		}
+	}
+	return nr.loadLabels(node)
+}
+
+// loadLabels reads the stored labels of the node into node.Labels
+func (nr *Repo) loadLabels(node *Node) error {
+	node.Labels = nil
+	return nr.each(selectNodeLabels, []interface{}{node.Gid}, func(rows *sql.Rows) error {
+		var label string
+		if err := rows.Scan(&label); err != nil {
+			return err
+		}
+		node.Labels = append(node.Labels, label)
+		return nil
+	})
+}
+
+// NodesWithLabels returns the nodes that have all the given labels, ordered by gid
+func (nr *Repo) NodesWithLabels(labels []string) ([]Node, error) {
+	if nr.err != nil {
+		return nil, nr.err
+	}
+	labels = normalizeLabels(labels)
+	if labels == nil {
+		return nil, nil
+	}
+	return nr.queryNodes(selectNodesWithLabels, pq.Array(labels), len(labels))
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/andrebq/ograph/metrics"
+)
+
+type (
+	// Metrics counts the work done by the Repo values that share it,
+	// the counters are safe for concurrent use.
+	Metrics struct {
+		Registry *metrics.Registry
+
+		// NodeWrites counts the nodes written, by op: save, upsert or delete
+		NodeWrites *metrics.Counter
+		// RelationWrites counts the relations written, by op: save or delete
+		RelationWrites *metrics.Counter
+		// Walks counts the calls to WalkEach
+		Walks       *metrics.Counter
+		WalkRows    *metrics.Histogram
+		WalkSeconds *metrics.Histogram
+		// KeywordLookups counts the keywords read, by source: cache,
+		// database or missing
+		KeywordLookups *metrics.Counter
+		// Transactions counts the transactions ended, by result: commit or rollback.
+		// A commit that fails counts as a rollback.
+		Transactions       *metrics.Counter
+		TransactionSeconds *metrics.Histogram
+		// Errors counts the errors returned to the callers, by kind,
+		// see CountError
+		Errors *metrics.Counter
+	}
+)
+
+// NewMetrics creates the metrics in reg, a nil reg uses a new Registry
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	if reg == nil {
+		reg = metrics.NewRegistry()
+	}
+	return &Metrics{
+		Registry:           reg,
+		NodeWrites:         reg.Counter("ograph_node_writes_total", "Nodes written, by operation", "op"),
+		RelationWrites:     reg.Counter("ograph_relation_writes_total", "Relations written, by operation", "op"),
+		Walks:              reg.Counter("ograph_walks_total", "Walks from a node"),
+		WalkRows:           reg.Histogram("ograph_walk_rows", "Relations returned by a walk", []float64{0, 1, 10, 100, 1000, 10000}),
+		WalkSeconds:        reg.Histogram("ograph_walk_seconds", "Duration of a walk", nil),
+		KeywordLookups:     reg.Counter("ograph_keyword_lookups_total", "Keywords read, by source", "source"),
+		Transactions:       reg.Counter("ograph_transactions_total", "Transactions ended, by result", "result"),
+		TransactionSeconds: reg.Histogram("ograph_transaction_seconds", "Duration of a transaction, by result", nil, "result"),
+		Errors:             reg.Counter("ograph_errors_total", "Errors, by kind", "kind"),
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return m.Registry
+}
+
+// CountError counts an error of the given kind. The data package doesn't
+// know the kinds, they are defined by the callers.
+func (m *Metrics) CountError(kind string) {
+	if m != nil {
+		m.Errors.Inc(kind)
+	}
+}
+
+// The methods below are called by the Repo and do nothing on a nil Metrics
+
+func (m *Metrics) nodeWrite(op string, err error) {
+	if m != nil && err == nil {
+		m.NodeWrites.Inc(op)
+	}
+}
+
+func (m *Metrics) relationWrite(op string, err error) {
+	if m != nil && err == nil {
+		m.RelationWrites.Inc(op)
+	}
+}
+
+func (m *Metrics) walk(rows int, started time.Time) {
+	if m != nil {
+		m.Walks.Inc()
+		m.WalkRows.Observe(float64(rows))
+		m.WalkSeconds.Observe(time.Since(started).Seconds())
+	}
+}
+
+func (m *Metrics) keywordLookup(source string) {
+	if m != nil {
+		m.KeywordLookups.Inc(source)
+	}
+}
+
+func (m *Metrics) transaction(committed bool, started time.Time) {
+	if m == nil {
+		return
+	}
+	result := "rollback"
+	if committed {
+		result = "commit"
+	}
+	m.Transactions.Inc(result)
+	m.TransactionSeconds.Observe(time.Since(started).Seconds(), result)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+)
+
+type (
+	preparer interface {
+		Prepare(query string) (*sql.Stmt, error)
+	}
+
+	// implemented by *sql.Tx
+	txStmter interface {
+		Stmt(stmt *sql.Stmt) *sql.Stmt
+	}
+)
+
+// preparedQueries are the constant statements that are prepared once and reused,
+// queries built for each call (walks with options, traversals, ...) aren't prepared
+var preparedQueries = map[string]bool{
+	selectKeywordByGid:    true,
+	selectKeywordByName:   true,
+	insertKeyword:         true,
+	lockKeyword:           true,
+	selectNodeByGid:       true,
+	selectNodeByNameEq:    true,
+	selectNodesByGid:      true,
+	selectNodesByName:     true,
+	insertNode:            true,
+	updateNode:            true,
+	upsertNodeKeep:        true,
+	selectNodeKeep:        true,
+	upsertNodeMerge:       true,
+	upsertNodeReplace:     true,
+	insertRelation:        true,
+	updateRelation:        true,
+	updateRelationByRid:   true,
+	selectRelation:        true,
+	selectRelationByRid:   true,
+	deleteRelationByRid:   true,
+	deleteNodeRelations:   true,
+	deleteNodeLabels:      true,
+	deleteNode:            true,
+	deleteRelations:       true,
+	selectRelationWalk:    true,
+	deleteOtherLabels:     true,
+	insertLabels:          true,
+	selectNodeLabels:      true,
+	selectNodesWithLabels: true,
+	selectRelationRule:    true,
+	selectEndpointsMatch:  true,
+	lockRelationEndpoint:  true,
+	countOtherOutgoing:    true,
+	upsertSchema:          true,
+	deleteSchema:          true,
+	renameSchema:          true,
+	selectAllSchemas:      true,
+	countOtherIncoming:    true,
+	countOutgoing:         true,
+	countIncoming:         true,
+	countOutgoingByName:   true,
+	countIncomingByName:   true,
+	existsRelation:        true,
+	existsRelations:       true,
+	selectChanges:         true,
+	trimChanges:           true,
+}
+
+// prepared returns the prepared statement for query, bound to the active
+// transaction, or nil when the query should be sent as text
+func (r *Repo) prepared(query string) *sql.Stmt {
+	if r.Unprepared || !preparedQueries[query] {
+		return nil
+	}
+	if r.Transaction == nil {
+		return r.dbStatement(query)
+	}
+	if txStmt, ok := r.txStmts[query]; ok {
+		return txStmt
+	}
+	var txStmt *sql.Stmt
+	if stmt, ok := r.stmts[query]; ok {
+		tx, ok := r.Transaction.(txStmter)
+		if !ok {
+			return nil
+		}
+		// the connection of the transaction prepares the statement
+		// only the first time it is used
+		txStmt = tx.Stmt(stmt)
+	} else {
+		// preparing on the Db would need a second connection while the
+		// transaction holds one, the statement is prepared by the
+		// transaction and on the Db after it ends, see endStatements
+		p, ok := r.Transaction.(preparer)
+		if !ok {
+			return nil
+		}
+		var err error
+		if txStmt, err = p.Prepare(query); err != nil {
+			// the statement runs as text and reports the error
+			return nil
+		}
+		r.unprepared = append(r.unprepared, query)
+	}
+	if r.txStmts == nil {
+		r.txStmts = make(map[string]*sql.Stmt)
+	}
+	r.txStmts[query] = txStmt
+	return txStmt
+}
+
+// dbStatement returns the statement prepared on the Db, preparing it
+// the first time
+func (r *Repo) dbStatement(query string) *sql.Stmt {
+	if stmt, ok := r.stmts[query]; ok {
+		return stmt
+	}
+	p, ok := r.Db.(preparer)
+	if !ok {
+		return nil
+	}
+	stmt, err := p.Prepare(query)
+	if err != nil {
+		return nil
+	}
+	if r.stmts == nil {
+		r.stmts = make(map[string]*sql.Stmt)
+	}
+	r.stmts[query] = stmt
+	return stmt
+}
+
+// endStatements discards the statements of the transaction that just ended
+// and prepares on the Db the ones it used for the first time
+func (r *Repo) endStatements() {
+	r.txStmts = nil
+	unprepared := r.unprepared
+	r.unprepared = nil
+	if r.Unprepared {
+		return
+	}
+	for _, query := range unprepared {
+		r.dbStatement(query)
+	}
+}
+
+// closeStatements discards the prepared statements, used when the tables change
+func (r *Repo) closeStatements() {
+	for _, stmt := range r.stmts {
+		stmt.Close()
+	}
+	r.stmts = nil
+	r.txStmts = nil
+	r.unprepared = nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type (
+	// Profile records the statements run by a Repo while Repo.Profile is set
+	Profile struct {
+		// Analyze runs EXPLAIN (ANALYZE, BUFFERS) before each select and
+		// keeps the output in Statement.Plan. The select runs twice.
+		Analyze bool
+
+		Statements []Statement
+	}
+
+	// Statement is a statement sent to the database
+	Statement struct {
+		// the Repo method that sent the statement, eg.: WalkEach
+		Call string
+		SQL  string
+		Args []interface{}
+
+		// Exec is the time until the database answered and Fetch the
+		// time spent reading the rows, including the caller's work on each row
+		Exec  time.Duration
+		Fetch time.Duration
+
+		// rows returned by a query or changed by an exec, -1 when unknown
+		Rows int64
+		Err  error
+
+		// output of EXPLAIN (ANALYZE, BUFFERS), only for selects when
+		// Profile.Analyze is true
+		Plan    string
+		PlanErr error
+
+		started time.Time
+	}
+
+	// CallTiming sums the statements sent by a Repo method
+	CallTiming struct {
+		Call       string
+		Statements int
+		Rows       int64
+		Exec       time.Duration
+		Fetch      time.Duration
+	}
+)
+
+// Total is the time spent by the statement
+func (s *Statement) Total() time.Duration {
+	return s.Exec + s.Fetch
+}
+
+// Total is the time spent by all the statements
+func (p *Profile) Total() time.Duration {
+	var total time.Duration
+	for i := range p.Statements {
+		total += p.Statements[i].Total()
+	}
+	return total
+}
+
+// Calls groups the statements by the Repo method that sent them,
+// the slowest first
+func (p *Profile) Calls() []CallTiming {
+	byCall := make(map[string]*CallTiming)
+	var out []CallTiming
+	var order []string
+	for _, st := range p.Statements {
+		ct, ok := byCall[st.Call]
+		if !ok {
+			ct = &CallTiming{Call: st.Call}
+			byCall[st.Call] = ct
+			order = append(order, st.Call)
+		}
+		ct.Statements++
+		if st.Rows > 0 {
+			ct.Rows += st.Rows
+		}
+		ct.Exec += st.Exec
+		ct.Fetch += st.Fetch
+	}
+	for _, call := range order {
+		out = append(out, *byCall[call])
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Exec+out[i].Fetch > out[j].Exec+out[j].Fetch
+	})
+	return out
+}
+
+// String formats the profile as a report with the timings by call
+// followed by each statement and its plan
+func (p *Profile) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "total %v in %d statements\n", p.Total(), len(p.Statements))
+	for _, ct := range p.Calls() {
+		fmt.Fprintf(&buf, "  %v: %d statements, %d rows, exec %v, fetch %v\n", ct.Call, ct.Statements, ct.Rows, ct.Exec, ct.Fetch)
+	}
+	for i, st := range p.Statements {
+		fmt.Fprintf(&buf, "\n#%d %v: exec %v, fetch %v, rows %d\n%v\n", i+1, st.Call, st.Exec, st.Fetch, st.Rows, st.SQL)
+		if len(st.Args) > 0 {
+			fmt.Fprintf(&buf, "args: %v\n", st.Args)
+		}
+		if st.Err != nil {
+			fmt.Fprintf(&buf, "error: %v\n", st.Err)
+		}
+		if len(st.Plan) > 0 {
+			fmt.Fprintf(&buf, "%v\n", st.Plan)
+		} else if st.PlanErr != nil {
+			fmt.Fprintf(&buf, "explain error: %v\n", st.PlanErr)
+		}
+	}
+	return buf.String()
+}
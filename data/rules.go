@@ -0,0 +1,256 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+type (
+	// Cardinality limits how many relations with the same name
+	// a node can have
+	Cardinality int
+
+	// RelationRule constrains the relations with a given name,
+	// it is checked by SaveRelation
+	RelationRule struct {
+		Name        string
+		Cardinality Cardinality
+		NoSelfLoops bool
+		// Multi allows many relations with this name between the same nodes,
+		// each one is saved as a new relation unless its Rid is set
+		Multi bool
+
+		// sql LIKE patterns that the names of the endpoints must match,
+		// empty means any node
+		FromPattern string
+		ToPattern   string
+	}
+
+	// RuleError is returned by SaveRelation when the relation
+	// breaks its RelationRule
+	RuleError struct {
+		Name    string
+		FromGid uint64
+		ToGid   uint64
+		Reason  string
+	}
+)
+
+const (
+	// ManyToMany doesn't limit the relations
+	ManyToMany = Cardinality(iota)
+	// ManyToOne allows one outgoing relation per node
+	ManyToOne
+	// OneToMany allows one incoming relation per node
+	OneToMany
+	// OneToOne allows one outgoing and one incoming relation per node
+	OneToOne
+)
+
+const (
+	selectRelationRule = `select cardinality, no_self_loops, from_pattern, to_pattern, multi
+		from relation_rules where kid = $1`
+	upsertRelationRule = `insert into relation_rules(kid, cardinality, no_self_loops, from_pattern, to_pattern, multi)
+		values ($1, $2, $3, $4, $5, $6)
+		on conflict (kid) do update set cardinality = excluded.cardinality,
+			no_self_loops = excluded.no_self_loops,
+			multi = excluded.multi,
+			from_pattern = excluded.from_pattern,
+			to_pattern = excluded.to_pattern`
+	deleteRelationRule = `delete from relation_rules where kid = $1`
+	selectEndpointsMatch = `select f.name like $3, t.name like $4
+		from nodes f, nodes t where f.gid = $1 and t.gid = $2`
+	lockRelationEndpoint = `select pg_advisory_xact_lock($1, $2)`
+	countOtherOutgoing = `select count(*) from relations where from_ = $1 and field = $2 and to_ <> $3`
+	countOtherIncoming = `select count(*) from relations where to_ = $1 and field = $2 and from_ <> $3`
+)
+
+func (c Cardinality) singleOutgoing() bool {
+	return c == ManyToOne || c == OneToOne
+}
+
+func (c Cardinality) singleIncoming() bool {
+	return c == OneToMany || c == OneToOne
+}
+
+func (c Cardinality) String() string {
+	switch c {
+	case ManyToMany:
+		return "many-to-many"
+	case ManyToOne:
+		return "many-to-one"
+	case OneToMany:
+		return "one-to-many"
+	case OneToOne:
+		return "one-to-one"
+	}
+	return fmt.Sprintf("cardinality(%d)", int(c))
+}
+
+// Error implements the error interface
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("relation %q from %v to %v: %v", e.Name, e.FromGid, e.ToGid, e.Reason)
+}
+
+// SaveRelationRule creates or replaces the rule for relations named rule.Name.
+// Relations saved before the rule aren't checked.
+func (r *Repo) SaveRelationRule(rule *RelationRule) error {
+	if !r.Begin() {
+		return r.err
+	}
+	kw := Keyword{Name: rule.Name}
+	if r.SaveKeyword(&kw) != nil {
+		return r.err
+	}
+	_, r.err = r.exec(upsertRelationRule, kw.Gid, int(rule.Cardinality), rule.NoSelfLoops, rule.FromPattern, rule.ToPattern, rule.Multi)
+	return r.err
+}
+
+// RelationRule reads the rule for relations with the given name,
+// returns sql.ErrNoRows if there isn't one
+func (r *Repo) RelationRule(name string, out *RelationRule) error {
+	if r.err != nil {
+		return r.err
+	}
+	kw, found, err := r.lookupKeyword(name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return sql.ErrNoRows
+	}
+	found, err = r.fetchRelationRule(kw.Gid, out)
+	if err != nil {
+		r.err = err
+		return err
+	}
+	if !found {
+		return sql.ErrNoRows
+	}
+	out.Name = kw.Name
+	return nil
+}
+
+// DeleteRelationRule removes the rule for relations with the given name
+func (r *Repo) DeleteRelationRule(name string) error {
+	if !r.Begin() {
+		return r.err
+	}
+	var kw Keyword
+	if err := r.Keyword(name, &kw); err == sql.ErrNoRows {
+		// no keyword, no rule
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, r.err = r.exec(deleteRelationRule, kw.Gid)
+	return r.err
+}
+
+func (r *Repo) fetchRelationRule(kid uint32, out *RelationRule) (bool, error) {
+	var cardinality int
+	err := r.queryRow(selectRelationRule, kid).Scan(&cardinality, &out.NoSelfLoops, &out.FromPattern, &out.ToPattern, &out.Multi)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	out.Cardinality = Cardinality(cardinality)
+	return err == nil, err
+}
+
+// checkRelationRule validates rel against its rule, the zero RelationRule
+// allows everything
+func (r *Repo) checkRelationRule(rel *Relation, rule *RelationRule) error {
+	var err error
+	violation := func(reason string, args ...interface{}) error {
+		return &RuleError{
+			Name:    rel.Name,
+			FromGid: rel.FromGid,
+			ToGid:   rel.ToGid,
+			Reason:  fmt.Sprintf(reason, args...),
+		}
+	}
+	if rule.NoSelfLoops && rel.FromGid == rel.ToGid {
+		return violation("self loops are not allowed")
+	}
+
+	if len(rule.FromPattern) > 0 || len(rule.ToPattern) > 0 {
+		fromPattern, toPattern := likeAny(rule.FromPattern), likeAny(rule.ToPattern)
+		var fromOk, toOk bool
+		err = r.queryRow(selectEndpointsMatch, rel.FromGid, rel.ToGid, fromPattern, toPattern).Scan(&fromOk, &toOk)
+		if err != nil {
+			return err
+		}
+		if !fromOk {
+			return violation("the name of the source node must match %q", fromPattern)
+		}
+		if !toOk {
+			return violation("the name of the target node must match %q", toPattern)
+		}
+	}
+
+	var count int64
+	if rule.Cardinality.singleOutgoing() {
+		if err = r.lockEndpoint(rel.Field, rel.FromGid, false); err != nil {
+			return err
+		}
+		if err = r.queryRow(countOtherOutgoing, rel.FromGid, rel.Field, rel.ToGid).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return violation("%v relation allows one outgoing relation per node, node %v already has one", rule.Cardinality, rel.FromGid)
+		}
+	}
+	if rule.Cardinality.singleIncoming() {
+		if err = r.lockEndpoint(rel.Field, rel.ToGid, true); err != nil {
+			return err
+		}
+		if err = r.queryRow(countOtherIncoming, rel.ToGid, rel.Field, rel.FromGid).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return violation("%v relation allows one incoming relation per node, node %v already has one", rule.Cardinality, rel.ToGid)
+		}
+	}
+	return nil
+}
+
+// lockEndpoint serializes the transactions that check the cardinality of the
+// same node and relation name, the count and the insert of one transaction
+// can't interleave with another. The lock is released when the transaction ends.
+//
+// The gid and the direction are folded into the second key of the advisory lock,
+// nodes that share the key only wait for each other.
+func (r *Repo) lockEndpoint(kid uint32, gid uint64, incoming bool) error {
+	key := gid << 1
+	if incoming {
+		key |= 1
+	}
+	_, err := r.exec(lockRelationEndpoint, int32(kid), int32(uint32(key)))
+	return err
+}
+
+func likeAny(pattern string) string {
+	if len(pattern) == 0 {
+		return "%"
+	}
+	return pattern
+}
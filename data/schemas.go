@@ -0,0 +1,79 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+)
+
+type (
+	// SchemaSource is the JSON Schema registered for the attributes of
+	// the nodes with a label or of the relations with a name
+	SchemaSource struct {
+		// NodeSchema or RelationSchema
+		Kind string
+		// the label or the relation name
+		Key  string
+		Body string
+	}
+)
+
+const (
+	NodeSchema     = "node"
+	RelationSchema = "relation"
+)
+
+const (
+	upsertSchema = `insert into attribute_schemas(kind, key, body) values ($1, $2, $3)
+		on conflict (kind, key) do update set body = excluded.body`
+	deleteSchema     = `delete from attribute_schemas where kind = $1 and key = $2`
+	renameSchema     = `update attribute_schemas set key = $3 where kind = $1 and key = $2`
+	selectAllSchemas = `select kind, key, body from attribute_schemas order by kind, key`
+)
+
+// SaveSchema creates or replaces the schema, an empty Body removes it
+func (r *Repo) SaveSchema(s *SchemaSource) error {
+	if !r.Begin() {
+		return r.err
+	}
+	if len(s.Body) == 0 {
+		_, r.err = r.exec(deleteSchema, s.Kind, s.Key)
+	} else {
+		_, r.err = r.exec(upsertSchema, s.Kind, s.Key, s.Body)
+	}
+	return r.err
+}
+
+// Schemas reads every registered schema
+func (r *Repo) Schemas() ([]SchemaSource, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var out []SchemaSource
+	err := r.eachRow(selectAllSchemas, nil, func(rows *sql.Rows) error {
+		var s SchemaSource
+		if err := rows.Scan(&s.Kind, &s.Key, &s.Body); err != nil {
+			return err
+		}
+		out = append(out, s)
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Every statement sent by a Repo goes through the functions of this file,
+// so they can be recorded by a Profile and observed by the Hooks.
+
+// exec runs a statement that doesn't return rows
+func (r *Repo) exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.execOn(r.ActiveQuerier(), query, args...)
+}
+
+// execOn works like exec but without using the active transaction
+func (r *Repo) execOn(q Querier, query string, args ...interface{}) (sql.Result, error) {
+	st := r.startStatement(q, query, args)
+	var res sql.Result
+	var err error
+	if stmt := r.prepared(query); stmt != nil && q == r.ActiveQuerier() {
+		res, err = stmt.Exec(args...)
+	} else {
+		res, err = q.Exec(query, args...)
+	}
+	rows := int64(-1)
+	if err == nil {
+		if n, rerr := res.RowsAffected(); rerr == nil {
+			rows = n
+		}
+	}
+	r.endStatement(st, rows, err)
+	return res, err
+}
+
+// queryRow runs a query that returns at most one row
+func (r *Repo) queryRow(query string, args ...interface{}) *sql.Row {
+	q := r.ActiveQuerier()
+	st := r.startStatement(q, query, args)
+	// the query runs before QueryRow returns, only Scan is left
+	var row *sql.Row
+	if stmt := r.prepared(query); stmt != nil {
+		row = stmt.QueryRow(args...)
+	} else {
+		row = q.QueryRow(query, args...)
+	}
+	r.endStatement(st, -1, row.Err())
+	return row
+}
+
+// each runs a query and calls fn for each row, an error from fn stops
+// the loop and is returned
+func (r *Repo) each(query string, args []interface{}, fn func(*sql.Rows) error) error {
+	q := r.ActiveQuerier()
+	st := r.startStatement(q, query, args)
+	var rows *sql.Rows
+	var err error
+	if stmt := r.prepared(query); stmt != nil {
+		rows, err = stmt.Query(args...)
+	} else {
+		rows, err = q.Query(query, args...)
+	}
+	if err != nil {
+		r.endStatement(st, -1, err)
+		return err
+	}
+	defer rows.Close()
+	if st != nil {
+		st.Exec = time.Since(st.started)
+	}
+	count := int64(0)
+	for rows.Next() {
+		count++
+		if err = fn(rows); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	r.endStatement(st, count, err)
+	return err
+}
+
+// eachRow works like each, but errors from the database are kept as the
+// error of the Repo while errors from fn are only returned
+func (r *Repo) eachRow(query string, args []interface{}, fn func(*sql.Rows) error) error {
+	var fnErr error
+	err := r.each(query, args, func(rows *sql.Rows) error {
+		fnErr = fn(rows)
+		return fnErr
+	})
+	if err != nil && err != fnErr {
+		r.err = err
+	}
+	return err
+}
+
+// startStatement returns nil if the statement isn't recorded nor observed
+func (r *Repo) startStatement(q Querier, query string, args []interface{}) *Statement {
+	if r.Profile == nil && len(r.Hooks) == 0 {
+		return nil
+	}
+	st := &Statement{
+		Call: repoCall(),
+		SQL:  query,
+		Args: args,
+	}
+	if r.Profile != nil && r.Profile.Analyze && isSelect(query) {
+		// explain runs before the statement, a connection cannot run
+		// other queries while the rows of a query are being read
+		st.Plan, st.PlanErr = explain(q, query, args, r.Transaction != nil)
+	}
+	for _, h := range r.Hooks {
+		h.Before(st)
+	}
+	st.started = time.Now()
+	return st
+}
+
+func (r *Repo) endStatement(st *Statement, rows int64, err error) {
+	if st == nil {
+		return
+	}
+	elapsed := time.Since(st.started)
+	if st.Exec == 0 {
+		st.Exec = elapsed
+	} else {
+		st.Fetch = elapsed - st.Exec
+	}
+	st.Rows = rows
+	st.Err = err
+	for _, h := range r.Hooks {
+		h.After(st)
+	}
+	if r.Profile != nil {
+		r.Profile.Statements = append(r.Profile.Statements, *st)
+	}
+}
+
+func isSelect(query string) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	return strings.HasPrefix(query, "select") || strings.HasPrefix(query, "with")
+}
+
+// explain returns the plan of the query, inside a transaction it uses a
+// savepoint so an error doesn't abort the transaction
+func explain(q Querier, query string, args []interface{}, inTransaction bool) (plan string, err error) {
+	if inTransaction {
+		if _, err = q.Exec("savepoint ograph_explain"); err != nil {
+			return "", err
+		}
+		defer func() {
+			if err != nil {
+				q.Exec("rollback to savepoint ograph_explain")
+			} else {
+				q.Exec("release savepoint ograph_explain")
+			}
+		}()
+	}
+	rows, err := q.Query("explain (analyze, buffers) "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err = rows.Scan(&line); err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+var repoMethodPrefix = reflect.TypeOf(Repo{}).PkgPath() + ".(*Repo)."
+
+// repoCall returns the name of the innermost exported Repo method in the
+// call stack, which is the call that ran the statement, eg.: WalkEach
+// when G.Walk calls Repo.WalkWith
+func repoCall() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, repoMethodPrefix) {
+			name := strings.TrimPrefix(frame.Function, repoMethodPrefix)
+			if len(name) > 0 && name[0] >= 'A' && name[0] <= 'Z' && !strings.Contains(name, ".") {
+				return name
+			}
+		}
+		if !more {
+			return ""
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+)
+
+type (
+	// Direction of the relations counted by Degree
+	Direction int
+
+	// NodeDegree is a node with the number of relations from and to it
+	NodeDegree struct {
+		Node
+		Outgoing int64
+		Incoming int64
+	}
+
+	// RelationKey identifies the relations checked by HasRelations
+	RelationKey struct {
+		FromGid uint64
+		ToGid   uint64
+		Name    string
+	}
+
+	// Summary describes the whole graph
+	Summary struct {
+		Nodes     int64
+		Relations []KeywordUsage
+		// the nodes with more relations, in any direction
+		TopNodes []NodeDegree
+	}
+)
+
+const (
+	Outgoing = Direction(iota)
+	Incoming
+)
+
+const (
+	countOutgoing       = `select count(*) from relations where from_ = $1`
+	countIncoming       = `select count(*) from relations where to_ = $1`
+	countOutgoingByName = `select count(*) from relations where from_ = $1 and field = $2`
+	countIncomingByName = `select count(*) from relations where to_ = $1 and field = $2`
+	countNodes          = `select count(*) from nodes`
+	existsRelation      = `select exists(select 1 from relations where from_ = $1 and to_ = $2 and field = $3)`
+	existsRelations     = `select k.i, exists(select 1 from relations r where r.from_ = k.f and r.to_ = k.t and r.field = k.kid)
+		from unnest($1::bigint[], $2::bigint[], $3::int[], $4::int[]) as k(f, t, kid, i)`
+	selectTopDegree     = `select n.gid, n.name, n.attributes,
+		(select array_agg(l.label order by l.label) from labels l where l.gid = n.gid),
+		d.outgoing, d.incoming
+		from (select gid, sum(o) as outgoing, sum(i) as incoming
+			from (select from_ as gid, 1 as o, 0 as i from relations
+				union all
+				select to_ as gid, 0 as o, 1 as i from relations) e
+			group by gid
+			order by sum(o) + sum(i) desc, gid
+			limit $1) d
+			inner join nodes n
+				on n.gid = d.gid
+		order by d.outgoing + d.incoming desc, n.gid`
+)
+
+// Degree counts the relations from (Outgoing) or to (Incoming) the node,
+// an empty name counts the relations with any name
+func (r *Repo) Degree(gid uint64, name string, dir Direction) (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	var query string
+	args := []interface{}{gid}
+	if len(name) == 0 {
+		query = countOutgoing
+		if dir == Incoming {
+			query = countIncoming
+		}
+	} else {
+		kw, found, err := r.lookupKeyword(name)
+		if err != nil || !found {
+			// no keyword means no relation
+			return 0, err
+		}
+		query = countOutgoingByName
+		if dir == Incoming {
+			query = countIncomingByName
+		}
+		args = append(args, kw.Gid)
+	}
+	var count int64
+	err := r.queryRow(query, args...).Scan(&count)
+	return count, err
+}
+
+// Summary counts the nodes and relations of the graph and finds
+// the top nodes with more relations
+func (r *Repo) Summary(top int) (*Summary, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	out := &Summary{}
+	if err := r.queryRow(countNodes).Scan(&out.Nodes); err != nil {
+		return nil, err
+	}
+	var err error
+	if out.Relations, err = r.KeywordUsage(); err != nil {
+		return nil, err
+	}
+	if top <= 0 {
+		return out, nil
+	}
+	err = r.each(selectTopDegree, []interface{}{top}, func(rows *sql.Rows) error {
+		var nd NodeDegree
+		err := rows.Scan(&nd.Gid, &nd.Name, &nd.Attributes, (*pq.StringArray)(&nd.Labels), &nd.Outgoing, &nd.Incoming)
+		if err != nil {
+			return err
+		}
+		out.TopNodes = append(out.TopNodes, nd)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HasRelation checks if there is at least one relation with the given name
+// from one node to the other
+func (r *Repo) HasRelation(from, to uint64, name string) (bool, error) {
+	if r.err != nil {
+		return false, r.err
+	}
+	kw, found, err := r.lookupKeyword(name)
+	if err != nil || !found {
+		return false, err
+	}
+	var exists bool
+	err = r.queryRow(existsRelation, from, to, kw.Gid).Scan(&exists)
+	return exists, err
+}
+
+// HasRelations works like HasRelation for many keys using a single query,
+// the result has the same order as keys
+func (r *Repo) HasRelations(keys []RelationKey) ([]bool, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	out := make([]bool, len(keys))
+	var from, to []int64
+	var kids, idx []int64
+	for i, k := range keys {
+		kw, found, err := r.lookupKeyword(k.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		from = append(from, int64(k.FromGid))
+		to = append(to, int64(k.ToGid))
+		kids = append(kids, int64(kw.Gid))
+		idx = append(idx, int64(i))
+	}
+	if len(idx) == 0 {
+		return out, nil
+	}
+	args := []interface{}{pq.Array(from), pq.Array(to), pq.Array(kids), pq.Array(idx)}
+	err := r.each(existsRelations, args, func(rows *sql.Rows) error {
+		var i int
+		var exists bool
+		if err := rows.Scan(&i, &exists); err != nil {
+			return err
+		}
+		out[i] = exists
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
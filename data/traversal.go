@@ -0,0 +1,388 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+)
+
+type (
+	// StepKind is what a Step does
+	StepKind int
+
+	// Step is one step of a Traversal
+	Step struct {
+		Kind StepKind
+
+		// Out, In and Both: the relation names to follow, empty follows any relation
+		Names []string
+
+		// Has: compares the attribute Key to Value, the key "name"
+		// is the name of the node
+		Key   string
+		Value interface{}
+
+		// HasLabel: the node must have all the labels
+		Labels []string
+
+		// Repeat: Body is repeated until the node matches Until, at most
+		// Times times. Paths in a repeat never visit the same node twice.
+		Body  []Step
+		Until []Step
+		Times int
+	}
+
+	// Traversal moves from the Start nodes through Steps, every node
+	// reached by the last step is a Traverser
+	Traversal struct {
+		// nil starts from every node
+		Start []uint64
+		Steps []Step
+	}
+
+	// Traverser is a node reached by a Traversal and how it was reached
+	Traverser struct {
+		Node
+		// the gids of the nodes and the rids of the relations walked
+		Path []uint64
+		Rids []uint64
+		// the gids marked by StepAs, in order
+		Marks []uint64
+	}
+
+	// traversalSQL builds the query of a Traversal
+	traversalSQL struct {
+		args      []interface{}
+		ctes      []string
+		recursive bool
+		aliases   int
+	}
+
+	// segment is a select from the nodes or from a previous cte,
+	// the steps add joins and conditions to it
+	segment struct {
+		from  []string
+		where []string
+		// alias of the current node
+		node string
+		// expressions with the arrays of the path
+		path, rids, marks string
+		// alias of the cte read by the segment, if any
+		source string
+		// nodes already in the path cannot be visited again
+		simple bool
+	}
+)
+
+const (
+	// StepOut follows the relations from the node
+	StepOut = StepKind(iota)
+	// StepIn follows the relations to the node
+	StepIn
+	// StepBoth follows the relations in any direction
+	StepBoth
+	// StepHas keeps the nodes with an attribute
+	StepHas
+	// StepHasLabel keeps the nodes with labels
+	StepHasLabel
+	// StepDedup keeps only one traverser for each node
+	StepDedup
+	// StepAs marks the node, see Traverser.Marks
+	StepAs
+	// StepRepeat repeats a list of steps
+	StepRepeat
+)
+
+var (
+	ErrInvalidStep = errors.New("invalid traversal step")
+)
+
+// TraverseEach runs the traversal and calls fn for every traverser
+func (r *Repo) TraverseEach(t *Traversal, fn func(*Traverser) error) error {
+	if r.err != nil {
+		return r.err
+	}
+	var b traversalSQL
+	seg, err := b.traversal(t)
+	if err != nil {
+		return err
+	}
+	query := b.with() + fmt.Sprintf("select %v.gid, %v.name, %v.attributes,\n\t\t(select array_agg(l.label order by l.label) from labels l where l.gid = %v.gid),\n\t\t%v, %v, %v",
+		seg.node, seg.node, seg.node, seg.node, seg.path, seg.rids, seg.marks) + seg.sql()
+
+	return r.eachRow(query, b.args, func(rows *sql.Rows) error {
+		tr := &Traverser{}
+		var path, rids, marks pq.Int64Array
+		if r.err = rows.Scan(&tr.Gid, &tr.Name, &tr.Attributes, (*pq.StringArray)(&tr.Labels), &path, &rids, &marks); r.err != nil {
+			return r.err
+		}
+		tr.Path, tr.Rids, tr.Marks = uint64s(path), uint64s(rids), uint64s(marks)
+		return fn(tr)
+	})
+}
+
+// TraverseCount counts the traversers of the traversal
+func (r *Repo) TraverseCount(t *Traversal) (int64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	var b traversalSQL
+	seg, err := b.traversal(t)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	r.err = r.queryRow(b.with()+"select count(*)"+seg.sql(), b.args...).Scan(&count)
+	return count, r.err
+}
+
+func uint64s(in pq.Int64Array) []uint64 {
+	out := make([]uint64, len(in))
+	for i, v := range in {
+		out[i] = uint64(v)
+	}
+	return out
+}
+
+func (b *traversalSQL) param(v interface{}) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *traversalSQL) alias(prefix string) string {
+	b.aliases++
+	return fmt.Sprintf("%v%d", prefix, b.aliases-1)
+}
+
+func (b *traversalSQL) with() string {
+	if len(b.ctes) == 0 {
+		return ""
+	}
+	if b.recursive {
+		return "with recursive " + strings.Join(b.ctes, ",\n") + "\n"
+	}
+	return "with " + strings.Join(b.ctes, ",\n") + "\n"
+}
+
+// sql returns the from and where clauses of the segment
+func (s *segment) sql() string {
+	out := "\nfrom " + strings.Join(s.from, "\n\t")
+	if len(s.where) > 0 {
+		out += "\nwhere " + strings.Join(s.where, " and ")
+	}
+	return out
+}
+
+func (b *traversalSQL) traversal(t *Traversal) (*segment, error) {
+	n := b.alias("n")
+	seg := &segment{
+		from:  []string{"nodes " + n},
+		node:  n,
+		path:  fmt.Sprintf("array[%v.gid]", n),
+		rids:  "'{}'::bigint[]",
+		marks: "'{}'::bigint[]",
+	}
+	if t.Start != nil {
+		seg.where = append(seg.where, fmt.Sprintf("%v.gid = any(%v)", n, b.param(pq.Array(t.Start))))
+	}
+	for _, st := range t.Steps {
+		var err error
+		if seg, err = b.step(seg, st); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// step applies st to seg, returns the segment used by the next step
+func (b *traversalSQL) step(seg *segment, st Step) (*segment, error) {
+	switch st.Kind {
+	case StepOut, StepIn, StepBoth:
+		b.hop(seg, st)
+	case StepHas, StepHasLabel:
+		cond, err := b.filter(seg.node, st)
+		if err != nil {
+			return nil, err
+		}
+		seg.where = append(seg.where, cond)
+	case StepAs:
+		seg.marks = fmt.Sprintf("(%v || %v.gid)", seg.marks, seg.node)
+	case StepDedup:
+		return b.next(b.cte(seg, true)), nil
+	case StepRepeat:
+		return b.repeat(seg, st)
+	default:
+		return nil, ErrInvalidStep
+	}
+	return seg, nil
+}
+
+// hop follows the relations from the current node, using the same joins
+// as selectRelationWalk
+func (b *traversalSQL) hop(seg *segment, st Step) {
+	r, kw, t := b.alias("r"), b.alias("kw"), b.alias("n")
+	var on, next string
+	switch st.Kind {
+	case StepOut:
+		on, next = fmt.Sprintf("%v.from_ = %v.gid", r, seg.node), r+".to_"
+	case StepIn:
+		on, next = fmt.Sprintf("%v.to_ = %v.gid", r, seg.node), r+".from_"
+	default:
+		on = fmt.Sprintf("(%v.from_ = %v.gid or %v.to_ = %v.gid)", r, seg.node, r, seg.node)
+		next = fmt.Sprintf("(case when %v.from_ = %v.gid then %v.to_ else %v.from_ end)", r, seg.node, r, r)
+	}
+	seg.from = append(seg.from, fmt.Sprintf("inner join relations %v on %v", r, on))
+	if len(st.Names) > 0 {
+		seg.from = append(seg.from, fmt.Sprintf("inner join keywords %v on %v.kid = %v.field and %v.name = any(%v)",
+			kw, kw, r, kw, b.param(pq.Array(st.Names))))
+	}
+	seg.from = append(seg.from, fmt.Sprintf("inner join nodes %v on %v.gid = %v", t, t, next))
+	if seg.simple {
+		seg.where = append(seg.where, fmt.Sprintf("not %v.gid = any(%v)", t, seg.path))
+	}
+	seg.node = t
+	seg.path = fmt.Sprintf("(%v || %v.gid)", seg.path, t)
+	seg.rids = fmt.Sprintf("(%v || %v.rid)", seg.rids, r)
+}
+
+// filter returns the condition of a Has or HasLabel step for the node
+func (b *traversalSQL) filter(node string, st Step) (string, error) {
+	switch st.Kind {
+	case StepHas:
+		if s, ok := st.Value.(string); ok && st.Key == "name" {
+			return fmt.Sprintf("%v.name = %v", node, b.param(s)), nil
+		}
+		buf, err := json.Marshal(st.Value)
+		if err != nil {
+			return "", err
+		}
+		if st.Key == "name" {
+			return fmt.Sprintf("to_jsonb(%v.name) = %v::jsonb", node, b.param(string(buf))), nil
+		}
+		return fmt.Sprintf("%v.attributes::jsonb -> %v = %v::jsonb", node, b.param(st.Key), b.param(string(buf))), nil
+	case StepHasLabel:
+		return fmt.Sprintf("(select count(*) from labels l where l.gid = %v.gid and l.label = any(%v)) = %v",
+			node, b.param(pq.Array(st.Labels)), b.param(len(normalizeLabels(st.Labels)))), nil
+	}
+	return "", ErrInvalidStep
+}
+
+// cte turns the segment into a cte and returns its name
+func (b *traversalSQL) cte(seg *segment, dedup bool) string {
+	name := b.alias("s")
+	sel := "select "
+	if dedup {
+		sel += fmt.Sprintf("distinct on (%v.gid) ", seg.node)
+	}
+	sel += fmt.Sprintf("%v.gid as cur, %v as path, %v as rids, %v as marks", seg.node, seg.path, seg.rids, seg.marks)
+	sel += seg.sql()
+	if dedup {
+		// keeps the shortest path, then the oldest relations
+		sel += fmt.Sprintf("\norder by %v.gid, array_length(%v, 1), %v", seg.node, seg.path, seg.rids)
+	}
+	b.ctes = append(b.ctes, fmt.Sprintf("%v as (%v)", name, sel))
+	return name
+}
+
+// next starts a segment that reads from the cte
+func (b *traversalSQL) next(cte string) *segment {
+	p, n := b.alias("p"), b.alias("n")
+	return &segment{
+		from:   []string{cte + " " + p, fmt.Sprintf("inner join nodes %v on %v.gid = %v.cur", n, n, p)},
+		node:   n,
+		source: p,
+		path:   p + ".path",
+		rids:   p + ".rids",
+		marks:  p + ".marks",
+	}
+}
+
+// repeat builds a recursive cte that applies the body to its own rows
+func (b *traversalSQL) repeat(seg *segment, st Step) (*segment, error) {
+	if len(st.Body) == 0 || (len(st.Until) == 0 && st.Times <= 0) {
+		return nil, ErrInvalidStep
+	}
+	start := b.cte(seg, false)
+	name := b.alias("s")
+	b.recursive = true
+
+	body := b.next(name)
+	body.simple = true
+	depth := body.source + ".depth"
+	// the body doesn't run for nodes that already match until
+	until, err := b.conditions(body.node, st.Until)
+	if err != nil {
+		return nil, err
+	}
+	if len(until) > 0 {
+		body.where = append(body.where, fmt.Sprintf("(%v = 0 or not (%v))", depth, until))
+	}
+	if st.Times > 0 {
+		body.where = append(body.where, fmt.Sprintf("%v < %v", depth, b.param(st.Times)))
+	}
+	for _, s := range st.Body {
+		switch s.Kind {
+		case StepOut, StepIn, StepBoth, StepHas, StepHasLabel:
+			if _, err := b.step(body, s); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrInvalidStep
+		}
+	}
+	b.ctes = append(b.ctes, fmt.Sprintf("%v(cur, path, rids, marks, depth) as (select cur, path, rids, marks, 0 from %v\n\tunion all\n\tselect %v.gid, %v, %v, %v, %v + 1%v)",
+		name, start, body.node, body.path, body.rids, body.marks, depth, body.sql()))
+
+	out := b.next(name)
+	depth = out.source + ".depth"
+	if until, err = b.conditions(out.node, st.Until); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(until) > 0 && st.Times > 0:
+		out.where = append(out.where, fmt.Sprintf("(%v = %v or (%v > 0 and %v))", depth, b.param(st.Times), depth, until))
+	case len(until) > 0:
+		out.where = append(out.where, fmt.Sprintf("%v > 0 and %v", depth, until))
+	default:
+		out.where = append(out.where, fmt.Sprintf("%v = %v", depth, b.param(st.Times)))
+	}
+	return out, nil
+}
+
+// conditions joins the filters of Until steps
+func (b *traversalSQL) conditions(node string, steps []Step) (string, error) {
+	var conds []string
+	for _, st := range steps {
+		cond, err := b.filter(node, st)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(conds, " and ") + ")", nil
+}
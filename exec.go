@@ -0,0 +1,127 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/andrebq/ograph/lang"
+	"github.com/lib/pq"
+)
+
+type (
+	// The rows returned by Exec
+	//
+	// Each value is a *Node, a *Relation (From and To only have the Gid),
+	// an int64 for id() and count(), a string for names and types, or
+	// the decoded JSON of an attribute, nil when the attribute is missing.
+	Result struct {
+		Columns []string
+		Rows    [][]interface{}
+	}
+)
+
+// Exec runs a query written in the language of the lang package,
+// params holds the values of the $parameters used by the query
+func (g *G) Exec(query string, params map[string]interface{}) (_ *Result, err error) {
+	defer g.returnError(&err)
+	q, err := lang.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := lang.Compile(q, params)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, col := range compiled.Columns {
+		res.Columns = append(res.Columns, col.Name)
+	}
+	err = g.repo.QueryEach(compiled.SQL, compiled.Args, func(rows *sql.Rows) error {
+		row, err := scanResult(rows, compiled.Columns)
+		if err != nil {
+			return err
+		}
+		res.Rows = append(res.Rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func scanResult(rows *sql.Rows, columns []lang.Column) ([]interface{}, error) {
+	var dest []interface{}
+	var read []func() (interface{}, error)
+	for _, col := range columns {
+		switch col.Kind {
+		case lang.NodeColumn:
+			n := &Node{}
+			var attributes sql.NullString
+			dest = append(dest, &n.Gid, &n.Name, &attributes, (*pq.StringArray)(&n.Labels))
+			read = append(read, func() (interface{}, error) {
+				n.Attributes = Attributes(attributes.String)
+				return n, nil
+			})
+		case lang.RelationColumn:
+			r := &Relation{From: &Node{}, To: &Node{}}
+			var attributes sql.NullString
+			dest = append(dest, &r.Rid, &r.From.Gid, &r.To.Gid, &r.Name, &attributes)
+			read = append(read, func() (interface{}, error) {
+				r.Attributes = Attributes(attributes.String)
+				return r, nil
+			})
+		case lang.JSONColumn:
+			var raw sql.NullString
+			dest = append(dest, &raw)
+			read = append(read, func() (interface{}, error) {
+				var v interface{}
+				if !raw.Valid {
+					return nil, nil
+				}
+				if err := json.Unmarshal([]byte(raw.String), &v); err != nil {
+					return nil, ErrInvalidEncoding
+				}
+				return v, nil
+			})
+		case lang.TextColumn:
+			var s string
+			dest = append(dest, &s)
+			read = append(read, func() (interface{}, error) { return s, nil })
+		case lang.IntegerColumn:
+			var i int64
+			dest = append(dest, &i)
+			read = append(read, func() (interface{}, error) { return i, nil })
+		}
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	row := make([]interface{}, len(read))
+	for i, fn := range read {
+		v, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		row[i] = v
+	}
+	return row, nil
+}
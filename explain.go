@@ -0,0 +1,46 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"github.com/andrebq/ograph/data"
+)
+
+// Explain runs fn and returns every statement sent to the database
+// while it ran, with the SQL, arguments and timings of each one.
+// With analyze, each select also has the output of EXPLAIN (ANALYZE, BUFFERS),
+// which runs the select a second time.
+//
+//	profile, err := g.Explain(true, func() error {
+//		_, err := g.Query(neo).Out("knows").Out("knows").Dedup().Nodes()
+//		return err
+//	})
+//	fmt.Println(profile)
+//
+// The profile is returned even when fn fails.
+func (g *G) Explain(analyze bool, fn func() error) (*data.Profile, error) {
+	previous := g.repo.Profile
+	profile := &data.Profile{Analyze: analyze}
+	g.repo.Profile = profile
+	defer func() {
+		g.repo.Profile = previous
+	}()
+	return profile, fn()
+}
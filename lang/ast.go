@@ -0,0 +1,156 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package lang
+
+type (
+	// Query is the AST of a query
+	Query struct {
+		Match  []Pattern
+		Where  Expr
+		Return []ReturnItem
+		// RETURN DISTINCT, each row is returned once
+		Distinct bool
+
+		OrderBy []OrderItem
+		// nil when absent, otherwise an integer Literal or a Param
+		Skip  Expr
+		Limit Expr
+	}
+
+	// Pattern is a path of nodes connected by relations,
+	// len(Rels) is always len(Nodes) - 1
+	Pattern struct {
+		Nodes []NodePattern
+		Rels  []RelPattern
+	}
+
+	// NodePattern matches a node, Var is empty for anonymous nodes
+	NodePattern struct {
+		Var    string
+		Labels []string
+		Props  []Property
+	}
+
+	// RelPattern matches a relation between the nodes before and after it,
+	// an empty Names matches any relation name
+	RelPattern struct {
+		Var   string
+		Names []string
+		Dir   Direction
+		Props []Property
+	}
+
+	// Property is an equality filter inside a pattern: {key: value}
+	Property struct {
+		Key   string
+		Value Expr
+	}
+
+	// Direction of a RelPattern, relative to the order of the pattern
+	Direction int
+
+	// ReturnItem is an expression returned by the query, Name is used
+	// as the column name
+	ReturnItem struct {
+		Expr Expr
+		Name string
+	}
+
+	// OrderItem sorts the results
+	OrderItem struct {
+		Expr Expr
+		Desc bool
+	}
+
+	// Expr is any expression
+	Expr interface {
+		expr()
+	}
+
+	// Literal is a string, float64, bool or nil
+	Literal struct {
+		Value interface{}
+	}
+
+	// Param is replaced by the value from the parameters given to Compile
+	Param struct {
+		Name string
+	}
+
+	// Var refers to a node or relation variable, or to a RETURN name
+	// when used in ORDER BY
+	Var struct {
+		Name string
+	}
+
+	// Prop reads a property of a variable
+	Prop struct {
+		Var  string
+		Path []string
+	}
+
+	// Call is a function call: id(x), type(r) or count(x). A nil Arg is count(*).
+	Call struct {
+		Func string
+		Arg  Expr
+	}
+
+	// Binary is a comparison (=, <>, <, <=, >, >=) or a logical operator (AND, OR)
+	Binary struct {
+		Op          string
+		Left, Right Expr
+	}
+
+	// Not negates a boolean expression
+	Not struct {
+		Expr Expr
+	}
+
+	// IsNull checks if a value is missing or null
+	IsNull struct {
+		Expr    Expr
+		Negated bool
+	}
+
+	// Exists is true when the pattern matches, the variables in the pattern
+	// must be bound by the MATCH or be anonymous
+	Exists struct {
+		Pattern Pattern
+	}
+)
+
+const (
+	// Right is (a)-[]->(b)
+	Right = Direction(iota)
+	// Left is (a)<-[]-(b)
+	Left
+	// Either is (a)-[]-(b)
+	Either
+)
+
+func (Literal) expr() {}
+func (Param) expr()   {}
+func (Var) expr()     {}
+func (Prop) expr()    {}
+func (Call) expr()    {}
+func (Binary) expr()  {}
+func (Not) expr()     {}
+func (IsNull) expr()  {}
+func (Exists) expr()  {}
@@ -0,0 +1,546 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package lang
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"math"
+	"reflect"
+	"strings"
+)
+
+type (
+	// Compiled is the SQL generated for a query
+	Compiled struct {
+		SQL  string
+		Args []interface{}
+		// Columns describes the values returned by the query, each Column
+		// uses Kind.Width() columns of the SQL result
+		Columns []Column
+	}
+
+	// Column is an item of RETURN
+	Column struct {
+		Name string
+		Kind ColumnKind
+	}
+
+	// ColumnKind tells how to read a Column
+	ColumnKind int
+
+	// CompileError is returned when a query is valid syntax but cannot
+	// be compiled, eg.: it uses an unknown variable
+	CompileError struct {
+		Msg string
+	}
+
+	compiler struct {
+		params  map[string]interface{}
+		args    []interface{}
+		aliases int
+	}
+
+	opKind int
+
+	// operand is a compiled value expression
+	operand struct {
+		kind opKind
+		sql  string
+		// for opValue
+		value interface{}
+		// for opNode and opRel
+		elem *element
+	}
+)
+
+const (
+	// NodeColumn is read from 4 columns: gid, name, attributes and labels
+	NodeColumn = ColumnKind(iota)
+	// RelationColumn is read from 5 columns: rid, from gid, to gid, name and attributes
+	RelationColumn
+	// JSONColumn is the JSON text of a value, NULL when the value is missing
+	JSONColumn
+	// TextColumn is a text value
+	TextColumn
+	// IntegerColumn is an integer value
+	IntegerColumn
+)
+
+const (
+	opJSON = opKind(iota)
+	opText
+	opInt
+	opValue
+	opNode
+	opRel
+	opCount
+)
+
+const (
+	selectNodeLabels = "(select array_agg(l.label order by l.label) from labels l where l.gid = %v.gid)"
+	selectRelName    = "(select kw.name from keywords kw where kw.kid = %v.field)"
+)
+
+func (e *CompileError) Error() string {
+	return e.Msg
+}
+
+// Width is the number of SQL columns used by the kind
+func (k ColumnKind) Width() int {
+	switch k {
+	case NodeColumn:
+		return 4
+	case RelationColumn:
+		return 5
+	}
+	return 1
+}
+
+// Compile generates the SQL for the query, params holds the values of the
+// parameters used by it
+func Compile(q *Query, params map[string]interface{}) (out *Compiled, err error) {
+	c := &compiler{params: params}
+	defer func() {
+		// like the parser, the compiler panics with *CompileError
+		if r := recover(); r != nil {
+			cerr, ok := r.(*CompileError)
+			if !ok {
+				panic(r)
+			}
+			out, err = nil, cerr
+		}
+	}()
+	return c.query(q), nil
+}
+
+func (c *compiler) fail(format string, args ...interface{}) {
+	panic(&CompileError{Msg: fmt.Sprintf(format, args...)})
+}
+
+func (c *compiler) alias(prefix string) string {
+	c.aliases++
+	return fmt.Sprintf("%v%d", prefix, c.aliases-1)
+}
+
+// param adds an argument to the query and returns its placeholder
+func (c *compiler) param(v interface{}) string {
+	c.args = append(c.args, v)
+	return fmt.Sprintf("$%d", len(c.args))
+}
+
+func (c *compiler) query(q *Query) *Compiled {
+	if len(q.Match) == 0 {
+		c.fail("query without MATCH")
+	}
+	if len(q.Return) == 0 {
+		c.fail("query without RETURN")
+	}
+	sc := newScope(nil)
+	c.bind(sc, q.Match, true)
+	from, where := c.from(sc)
+
+	// the same relation is never used twice by a match
+	var rels []*element
+	for _, e := range sc.elements {
+		if e.rel {
+			for _, other := range rels {
+				where = append(where, fmt.Sprintf("%v.rid <> %v.rid", other.alias, e.alias))
+			}
+			rels = append(rels, e)
+		}
+	}
+	if q.Where != nil {
+		where = append(where, c.cond(sc, q.Where))
+	}
+
+	out := &Compiled{}
+	var selects, groupBy, keys []string
+	aggregate := false
+	for _, item := range q.Return {
+		op := c.operand(sc, item.Expr)
+		col := Column{Name: item.Name}
+		switch op.kind {
+		case opNode:
+			col.Kind = NodeColumn
+			a := op.elem.alias
+			selects = append(selects, fmt.Sprintf("%v.gid, %v.name, %v.attributes, "+selectNodeLabels, a, a, a, a))
+		case opRel:
+			col.Kind = RelationColumn
+			a := op.elem.alias
+			selects = append(selects, fmt.Sprintf("%v.rid, %v.from_, %v.to_, "+selectRelName+", %v.attributes", a, a, a, a, a))
+		case opValue:
+			// evaluated once, unused parameters make the query fail
+			op = operand{kind: opJSON, sql: c.jsonValue(op.value)}
+			col.Kind = JSONColumn
+			selects = append(selects, op.sql+"::text")
+		case opJSON:
+			col.Kind = JSONColumn
+			selects = append(selects, op.sql+"::text")
+		case opText:
+			col.Kind = TextColumn
+			selects = append(selects, op.sql)
+		case opInt, opCount:
+			col.Kind = IntegerColumn
+			selects = append(selects, op.sql)
+		}
+		if op.kind == opCount {
+			aggregate = true
+		} else {
+			groupBy = append(groupBy, c.key(op))
+		}
+		keys = append(keys, c.key(op))
+		out.Columns = append(out.Columns, col)
+	}
+
+	sql := "select " + strings.Join(selects, ", ") + " from " + from
+	if len(where) > 0 {
+		sql += " where " + strings.Join(where, " and ")
+	}
+	// nodes and relations are grouped by their ids, the other columns
+	// depend on them
+	if (aggregate || q.Distinct) && len(groupBy) > 0 {
+		sql += " group by " + strings.Join(groupBy, ", ")
+	}
+	if len(q.OrderBy) > 0 {
+		var order []string
+		for _, item := range q.OrderBy {
+			key := ""
+			if v, ok := item.Expr.(Var); ok {
+				// RETURN names come before the variables
+				for i, ri := range q.Return {
+					if ri.Name == v.Name {
+						key = keys[i]
+						break
+					}
+				}
+			}
+			if len(key) == 0 {
+				op := c.operand(sc, item.Expr)
+				if op.kind == opValue {
+					c.fail("cannot order by a constant")
+				}
+				key = c.key(op)
+			}
+			if item.Desc {
+				key += " desc"
+			}
+			order = append(order, key)
+		}
+		sql += " order by " + strings.Join(order, ", ")
+	}
+	if q.Limit != nil {
+		sql += " limit " + c.param(c.count(q.Limit, "LIMIT"))
+	}
+	if q.Skip != nil {
+		sql += " offset " + c.param(c.count(q.Skip, "SKIP"))
+	}
+	out.SQL = sql
+	out.Args = c.args
+	return out
+}
+
+// from returns the FROM clause with the joins of the scope and the
+// conditions that filter its elements
+func (c *compiler) from(sc *scope) (string, []string) {
+	var from []string
+	var where []string
+	for i, st := range c.joinOrder(sc) {
+		table := "nodes " + st.elem.alias
+		if st.elem.rel {
+			table = "relations " + st.elem.alias
+		}
+		switch {
+		case i == 0:
+			from = append(from, table)
+			where = append(where, st.on...)
+		case len(st.on) == 0:
+			from = append(from, "cross join "+table)
+		default:
+			from = append(from, "inner join "+table+" on "+strings.Join(st.on, " and "))
+		}
+	}
+	for _, e := range sc.elements {
+		where = append(where, c.filter(sc, e, e.labels, e.props)...)
+		if e.rel && len(e.names) > 0 {
+			where = append(where, fmt.Sprintf("%v.field in (select kw.kid from keywords kw where kw.name = any(%v))",
+				e.alias, c.param(pq.Array(e.names))))
+		}
+	}
+	for _, f := range sc.filters {
+		where = append(where, c.filter(sc, f.elem, f.labels, f.props)...)
+	}
+	return strings.Join(from, " "), where
+}
+
+// filter returns the conditions for the labels and properties of e
+func (c *compiler) filter(sc *scope, e *element, labels []string, props []Property) []string {
+	var where []string
+	for _, label := range labels {
+		where = append(where, fmt.Sprintf("exists (select 1 from labels l where l.gid = %v.gid and l.label = %v)",
+			e.alias, c.param(label)))
+	}
+	for _, p := range props {
+		where = append(where, c.compare("=", c.prop(e, []string{p.Key}), c.operand(sc, p.Value)))
+	}
+	return where
+}
+
+// cond compiles a boolean expression
+func (c *compiler) cond(sc *scope, e Expr) string {
+	switch e := e.(type) {
+	case Binary:
+		if e.Op == "AND" || e.Op == "OR" {
+			return fmt.Sprintf("(%v %v %v)", c.cond(sc, e.Left), strings.ToLower(e.Op), c.cond(sc, e.Right))
+		}
+		return c.compare(e.Op, c.operand(sc, e.Left), c.operand(sc, e.Right))
+	case Not:
+		return fmt.Sprintf("not %v", c.cond(sc, e.Expr))
+	case IsNull:
+		op := c.operand(sc, e.Expr)
+		switch op.kind {
+		case opJSON:
+			if e.Negated {
+				return fmt.Sprintf("(%v is not null and %v <> 'null'::jsonb)", op.sql, op.sql)
+			}
+			return fmt.Sprintf("(%v is null or %v = 'null'::jsonb)", op.sql, op.sql)
+		case opValue:
+			return fmt.Sprintf("%v", (op.value == nil) != e.Negated)
+		case opCount:
+			c.fail("count cannot be used in WHERE")
+		}
+		if e.Negated {
+			return c.key(op) + " is not null"
+		}
+		return c.key(op) + " is null"
+	case Exists:
+		sub := newScope(sc)
+		c.bind(sub, []Pattern{e.Pattern}, false)
+		from, where := c.from(sub)
+		if len(where) == 0 {
+			return "exists (select 1 from " + from + ")"
+		}
+		return "exists (select 1 from " + from + " where " + strings.Join(where, " and ") + ")"
+	}
+	op := c.operand(sc, e)
+	switch op.kind {
+	case opJSON:
+		return fmt.Sprintf("(%v = 'true'::jsonb)", op.sql)
+	case opValue:
+		if b, ok := op.value.(bool); ok {
+			return fmt.Sprintf("%v", b)
+		}
+	}
+	c.fail("expecting a boolean expression")
+	return ""
+}
+
+// compare compiles a comparison, values of different types are
+// compared as json
+func (c *compiler) compare(op string, l, r operand) string {
+	for _, o := range []operand{l, r} {
+		switch o.kind {
+		case opNode, opRel:
+			c.fail("cannot compare %v, compare id(%v) instead", o.elem.name, o.elem.name)
+		case opCount:
+			c.fail("count cannot be used in WHERE")
+		}
+	}
+	var ls, rs string
+	var isJSON bool
+	switch {
+	case l.kind == opValue && r.kind == opValue:
+		ls, rs, isJSON = c.jsonValue(l.value), c.jsonValue(r.value), true
+	case l.kind == opValue:
+		rs, ls, isJSON = c.unify(r, l)
+	default:
+		ls, rs, isJSON = c.unify(l, r)
+	}
+	if isJSON && op != "=" && op != "<>" {
+		// jsonb orders values of different types, eg.: every number is
+		// smaller than any string, which isn't what a query means
+		return fmt.Sprintf("(jsonb_typeof(%v) = jsonb_typeof(%v) and %v %v %v)", ls, rs, ls, op, rs)
+	}
+	return fmt.Sprintf("%v %v %v", ls, op, rs)
+}
+
+// unify converts r to the type of l, l must not be a value
+func (c *compiler) unify(l, r operand) (string, string, bool) {
+	if r.kind == opValue {
+		switch l.kind {
+		case opJSON:
+			return l.sql, c.jsonValue(r.value), true
+		case opText:
+			if s, ok := r.value.(string); ok {
+				return l.sql, c.param(s), false
+			}
+		case opInt:
+			if n, ok := integerValue(r.value); ok {
+				return l.sql, c.param(n), false
+			}
+		}
+		return c.asJSON(l), c.jsonValue(r.value), true
+	}
+	if l.kind == r.kind {
+		return l.sql, r.sql, l.kind == opJSON
+	}
+	return c.asJSON(l), c.asJSON(r), true
+}
+
+func (c *compiler) asJSON(o operand) string {
+	if o.kind == opJSON {
+		return o.sql
+	}
+	return "to_jsonb(" + o.sql + ")"
+}
+
+func (c *compiler) jsonValue(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		c.fail("cannot encode %v: %v", v, err)
+	}
+	return c.param(string(buf)) + "::jsonb"
+}
+
+// key is the SQL expression that identifies the value of op
+func (c *compiler) key(op operand) string {
+	switch op.kind {
+	case opNode:
+		return op.elem.alias + ".gid"
+	case opRel:
+		return op.elem.alias + ".rid"
+	case opValue:
+		return c.jsonValue(op.value)
+	}
+	return op.sql
+}
+
+// count returns the value of SKIP or LIMIT
+func (c *compiler) count(e Expr, clause string) int64 {
+	var v interface{}
+	switch e := e.(type) {
+	case Literal:
+		v = e.Value
+	case Param:
+		v = c.paramValue(e.Name)
+	}
+	n, ok := integerValue(v)
+	if !ok || n < 0 {
+		c.fail("%v must be a non-negative integer", clause)
+	}
+	return n
+}
+
+func (c *compiler) paramValue(name string) interface{} {
+	v, ok := c.params[name]
+	if !ok {
+		c.fail("missing parameter $%v", name)
+	}
+	return v
+}
+
+// operand compiles a value expression
+func (c *compiler) operand(sc *scope, e Expr) operand {
+	switch e := e.(type) {
+	case Literal:
+		return operand{kind: opValue, value: e.Value}
+	case Param:
+		return operand{kind: opValue, value: c.paramValue(e.Name)}
+	case Var:
+		elem := c.variable(sc, e.Name)
+		if elem.rel {
+			return operand{kind: opRel, elem: elem}
+		}
+		return operand{kind: opNode, elem: elem}
+	case Prop:
+		return c.prop(c.variable(sc, e.Var), e.Path)
+	case Call:
+		return c.call(sc, e)
+	}
+	c.fail("expecting a value")
+	return operand{}
+}
+
+func (c *compiler) variable(sc *scope, name string) *element {
+	elem, ok := sc.lookup(name)
+	if !ok {
+		c.fail("%v is not defined", name)
+	}
+	return elem
+}
+
+// prop reads the name of a node or a path inside the attributes
+func (c *compiler) prop(e *element, path []string) operand {
+	if !e.rel && len(path) == 1 && path[0] == "name" {
+		return operand{kind: opText, sql: e.alias + ".name"}
+	}
+	return operand{kind: opJSON, sql: fmt.Sprintf("(%v.attributes::jsonb #> %v)", e.alias, c.param(pq.Array(path)))}
+}
+
+func (c *compiler) call(sc *scope, call Call) operand {
+	if call.Func == "count" && call.Arg == nil {
+		return operand{kind: opCount, sql: "count(*)"}
+	}
+	if call.Arg == nil {
+		c.fail("%v expects an argument", call.Func)
+	}
+	arg := c.operand(sc, call.Arg)
+	switch call.Func {
+	case "id":
+		if arg.kind == opNode || arg.kind == opRel {
+			return operand{kind: opInt, sql: c.key(arg)}
+		}
+		c.fail("id expects a node or a relation")
+	case "type":
+		if arg.kind == opRel {
+			return operand{kind: opText, sql: fmt.Sprintf(selectRelName, arg.elem.alias)}
+		}
+		c.fail("type expects a relation")
+	case "count":
+		if arg.kind == opCount {
+			c.fail("count cannot be nested")
+		}
+		return operand{kind: opCount, sql: "count(" + c.key(arg) + ")"}
+	}
+	c.fail("unknown function %v", call.Func)
+	return operand{}
+}
+
+// integerValue converts whole numbers of any type to int64
+func integerValue(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return 0, false
+		}
+		return int64(f), true
+	}
+	return 0, false
+}
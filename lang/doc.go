@@ -0,0 +1,20 @@
+// lang implements a small Cypher-like query language on top of the
+// tables created by the data package.
+//
+// A query has one or more MATCH patterns, an optional WHERE, a RETURN
+// (RETURN DISTINCT skips the repeated rows) and optionally ORDER BY,
+// SKIP and LIMIT:
+//
+//	MATCH (a:person {name: $who})-[r:knows]->(b)
+//	WHERE b.age >= 18 AND NOT (b)-[:blocked]->(a)
+//	RETURN a, b.name, r.since
+//	ORDER BY r.since DESC
+//	LIMIT 10
+//
+// Properties of nodes and relations are read from their attributes, except
+// name which is the name of the node. id(x) returns the Gid of a node or the
+// Rid of a relation and type(r) the name of a relation.
+//
+// Parse builds the AST, which can also be built directly, and Compile
+// plans the joins and generates the SQL.
+package lang
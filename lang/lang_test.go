@@ -0,0 +1,175 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package lang
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`MATCH (a:person {name: $who})-[r:knows|likes]->(b), (b)<--(c)
+		WHERE b.age >= 18 AND NOT (b)-[:blocked]-(a) AND r.since IS NOT NULL
+		RETURN a, b.name AS friend, count(*)
+		ORDER BY friend DESC
+		SKIP 1 LIMIT $max`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	expected := &Query{
+		Match: []Pattern{
+			{
+				Nodes: []NodePattern{
+					{Var: "a", Labels: []string{"person"}, Props: []Property{{Key: "name", Value: Param{Name: "who"}}}},
+					{Var: "b"},
+				},
+				Rels: []RelPattern{{Var: "r", Names: []string{"knows", "likes"}, Dir: Right}},
+			},
+			{
+				Nodes: []NodePattern{{Var: "b"}, {Var: "c"}},
+				Rels:  []RelPattern{{Dir: Left}},
+			},
+		},
+		Where: Binary{Op: "AND",
+			Left: Binary{Op: "AND",
+				Left: Binary{Op: ">=", Left: Prop{Var: "b", Path: []string{"age"}}, Right: Literal{Value: float64(18)}},
+				Right: Not{Expr: Exists{Pattern: Pattern{
+					Nodes: []NodePattern{{Var: "b"}, {Var: "a"}},
+					Rels:  []RelPattern{{Names: []string{"blocked"}, Dir: Either}},
+				}}},
+			},
+			Right: IsNull{Expr: Prop{Var: "r", Path: []string{"since"}}, Negated: true},
+		},
+		Return: []ReturnItem{
+			{Expr: Var{Name: "a"}, Name: "a"},
+			{Expr: Prop{Var: "b", Path: []string{"name"}}, Name: "friend"},
+			{Expr: Call{Func: "count"}, Name: "count(*)"},
+		},
+		OrderBy: []OrderItem{{Expr: Var{Name: "friend"}, Desc: true}},
+		Skip:    Literal{Value: float64(1)},
+		Limit:   Param{Name: "max"},
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Fatalf("invalid query. expecting %#v got %#v", expected, q)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		`RETURN 1`,
+		`MATCH (a RETURN a`,
+		`MATCH (a)-[:x]-(b) RETURN`,
+		`MATCH (a) RETURN a LIMIT`,
+		`MATCH (a) WHERE a.name = 'open RETURN a`,
+		`MATCH (a) RETURN a extra`,
+	} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%v should not be a valid query", input)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("expecting a *SyntaxError for %v got %#v", input, err)
+		}
+	}
+}
+
+func mustCompile(t *testing.T, input string, params map[string]interface{}) *Compiled {
+	q, err := Parse(input)
+	if err != nil {
+		t.Fatalf("error parsing %v: %v", input, err)
+	}
+	c, err := Compile(q, params)
+	if err != nil {
+		t.Fatalf("error compiling %v: %v", input, err)
+	}
+	return c
+}
+
+func TestCompile(t *testing.T) {
+	c := mustCompile(t, `MATCH (a)-[r:knows]->(b:person {name: $who})
+		WHERE a.age > 18
+		RETURN a, r, b.name, id(b) ORDER BY a.age DESC LIMIT 10`, map[string]interface{}{"who": "neo"})
+
+	// the join starts at the node with a name
+	if !strings.Contains(c.SQL, "from nodes n1 inner join relations r2 on r2.to_ = n1.gid inner join nodes n0 on n0.gid = r2.from_") {
+		t.Errorf("unexpected join order: %v", c.SQL)
+	}
+	if !strings.Contains(c.SQL, "jsonb_typeof") {
+		t.Errorf("ordering comparison should check the json type: %v", c.SQL)
+	}
+	if !strings.HasSuffix(c.SQL, "desc limit $7") {
+		t.Errorf("unexpected order by and limit: %v", c.SQL)
+	}
+	expected := []Column{
+		{Name: "a", Kind: NodeColumn},
+		{Name: "r", Kind: RelationColumn},
+		{Name: "b.name", Kind: TextColumn},
+		{Name: "id(b)", Kind: IntegerColumn},
+	}
+	if !reflect.DeepEqual(c.Columns, expected) {
+		t.Errorf("invalid columns. expecting %v got %v", expected, c.Columns)
+	}
+	if len(c.Args) != 7 || c.Args[6] != int64(10) {
+		t.Errorf("invalid args: %v", c.Args)
+	}
+	for i := 1; i <= len(c.Args); i++ {
+		if !strings.Contains(c.SQL, "$"+string(rune('0'+i))) {
+			t.Errorf("parameter %v is not used: %v", i, c.SQL)
+		}
+	}
+
+	c = mustCompile(t, `MATCH (a)--(b) RETURN b, count(*)`, nil)
+	if !strings.Contains(c.SQL, "group by n1.gid") || !strings.Contains(c.SQL, "case when") {
+		t.Errorf("unexpected sql: %v", c.SQL)
+	}
+
+	c = mustCompile(t, `MATCH (a)-->(b) RETURN DISTINCT a, b`, nil)
+	if !strings.Contains(c.SQL, "group by n0.gid, n1.gid") {
+		t.Errorf("unexpected sql: %v", c.SQL)
+	}
+
+	c = mustCompile(t, `MATCH (a)-->(b)-->(c) WHERE NOT (a)-->(c) RETURN c`, nil)
+	if !strings.Contains(c.SQL, "r3.rid <> r4.rid") || !strings.Contains(c.SQL, "not exists (select 1 from relations r5 where r5.from_ = n0.gid and r5.to_ = n2.gid)") {
+		t.Errorf("unexpected sql: %v", c.SQL)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, input := range []string{
+		`MATCH (a) RETURN b`,
+		`MATCH (a)-[a]->(b) RETURN a`,
+		`MATCH (a)-[r]->(b), (b)-[r]->(c) RETURN a`,
+		`MATCH (a) WHERE (a)-->(b) RETURN a`,
+		`MATCH (a), (b) WHERE a = b RETURN a`,
+		`MATCH (a) WHERE count(*) > 1 RETURN a`,
+		`MATCH (a) RETURN a LIMIT $missing`,
+		`MATCH (a) RETURN a LIMIT 1.5`,
+		`MATCH (a) RETURN lower(a.name)`,
+	} {
+		q, err := Parse(input)
+		if err != nil {
+			t.Fatalf("error parsing %v: %v", input, err)
+		}
+		if _, err := Compile(q, nil); err == nil {
+			t.Errorf("%v should not compile", input)
+		} else if _, ok := err.(*CompileError); !ok {
+			t.Errorf("expecting a *CompileError for %v got %#v", input, err)
+		}
+	}
+}
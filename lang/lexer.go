@@ -0,0 +1,208 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package lang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type (
+	tokenKind int
+
+	token struct {
+		kind tokenKind
+		// the text of identifiers, keywords (upper case) and punctuation
+		// or the decoded value of strings
+		text string
+		num  float64
+		pos  int
+	}
+
+	// SyntaxError is returned by Parse
+	SyntaxError struct {
+		Pos int
+		Msg string
+	}
+)
+
+const (
+	tokEOF = tokenKind(iota)
+	tokIdent
+	tokKeyword
+	tokString
+	tokNumber
+	tokParam
+	tokPunct
+)
+
+var keywords = map[string]bool{
+	"MATCH": true, "WHERE": true, "RETURN": true, "ORDER": true, "BY": true,
+	"ASC": true, "DESC": true, "SKIP": true, "LIMIT": true, "AS": true,
+	"AND": true, "OR": true, "NOT": true, "IS": true, "NULL": true,
+	"TRUE": true, "FALSE": true, "DISTINCT": true,
+}
+
+// Error implements the error interface
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %v: %v", e.Pos, e.Msg)
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokNumber:
+		return strconv.FormatFloat(t.num, 'g', -1, 64)
+	case tokParam:
+		return "$" + t.text
+	}
+	return strconv.Quote(t.text)
+}
+
+func lex(input string) ([]token, error) {
+	var out []token
+	i := 0
+	for i < len(input) {
+		r, size := utf8.DecodeRuneInString(input[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '/' && strings.HasPrefix(input[i:], "//"):
+			// comment until the end of the line
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case isIdentStart(r):
+			start := i
+			for i < len(input) {
+				r, size := utf8.DecodeRuneInString(input[i:])
+				if !isIdentStart(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			word := input[start:i]
+			if upper := strings.ToUpper(word); keywords[upper] {
+				out = append(out, token{kind: tokKeyword, text: upper, pos: start})
+			} else {
+				out = append(out, token{kind: tokIdent, text: word, pos: start})
+			}
+		case r == '`':
+			end := strings.IndexByte(input[i+1:], '`')
+			if end < 0 {
+				return nil, &SyntaxError{Pos: i, Msg: "unterminated quoted identifier"}
+			}
+			out = append(out, token{kind: tokIdent, text: input[i+1 : i+1+end], pos: i})
+			i += end + 2
+		case r == '$':
+			start := i
+			i++
+			for i < len(input) {
+				r, size := utf8.DecodeRuneInString(input[i:])
+				if !isIdentStart(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			if i == start+1 {
+				return nil, &SyntaxError{Pos: start, Msg: "missing parameter name after $"}
+			}
+			out = append(out, token{kind: tokParam, text: input[start+1 : i], pos: start})
+		case r == '\'' || r == '"':
+			str, n, err := lexString(input[i:])
+			if err != nil {
+				return nil, &SyntaxError{Pos: i, Msg: err.Error()}
+			}
+			out = append(out, token{kind: tokString, text: str, pos: i})
+			i += n
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(input) && (unicode.IsDigit(rune(input[i])) || input[i] == '.') {
+				if input[i] == '.' && (i+1 >= len(input) || !unicode.IsDigit(rune(input[i+1]))) {
+					break
+				}
+				i++
+			}
+			num, err := strconv.ParseFloat(input[start:i], 64)
+			if err != nil {
+				return nil, &SyntaxError{Pos: start, Msg: err.Error()}
+			}
+			out = append(out, token{kind: tokNumber, num: num, text: input[start:i], pos: start})
+		default:
+			start := i
+			for _, op := range []string{"<>", "<=", ">=", "!="} {
+				if strings.HasPrefix(input[i:], op) {
+					if op == "!=" {
+						op = "<>"
+					}
+					out = append(out, token{kind: tokPunct, text: op, pos: start})
+					i += 2
+					break
+				}
+			}
+			if i > start {
+				continue
+			}
+			if !strings.ContainsRune("()[]{}:,.-<>=|*", r) {
+				return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+			out = append(out, token{kind: tokPunct, text: string(r), pos: i})
+			i += size
+		}
+	}
+	return append(out, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// lexString decodes a quoted string, returning its value and how many
+// bytes were consumed
+func lexString(input string) (string, int, error) {
+	quote := input[0]
+	var buf strings.Builder
+	for i := 1; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == quote:
+			return buf.String(), i + 1, nil
+		case c == '\\' && i+1 < len(input):
+			i++
+			switch input[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			default:
+				buf.WriteByte(input[i])
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
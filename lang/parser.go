@@ -0,0 +1,367 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package lang
+
+import (
+	"fmt"
+	"strings"
+)
+
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+// Parse reads the text of a query
+func Parse(input string) (q *Query, err error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{input: input, tokens: tokens}
+	defer func() {
+		// the parser panics with *SyntaxError to avoid checking
+		// errors after every token
+		if r := recover(); r != nil {
+			serr, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			q, err = nil, serr
+		}
+	}()
+	q = p.query()
+	return q, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) fail(t token, format string, args ...interface{}) {
+	panic(&SyntaxError{Pos: t.pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// is checks if the next token is the keyword or punctuation
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokKeyword || t.kind == tokPunct) && t.text == text
+}
+
+// accept consumes the next token if it is the keyword or punctuation
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) token {
+	t := p.next()
+	if (t.kind != tokKeyword && t.kind != tokPunct) || t.text != text {
+		p.fail(t, "expecting %q got %v", text, t)
+	}
+	return t
+}
+
+func (p *parser) ident() string {
+	t := p.next()
+	if t.kind != tokIdent {
+		p.fail(t, "expecting an identifier got %v", t)
+	}
+	return t.text
+}
+
+func (p *parser) query() *Query {
+	q := &Query{}
+	p.expect("MATCH")
+	q.Match = append(q.Match, p.pattern())
+	for p.accept(",") {
+		q.Match = append(q.Match, p.pattern())
+	}
+	if p.accept("WHERE") {
+		q.Where = p.expr()
+	}
+	p.expect("RETURN")
+	q.Distinct = p.accept("DISTINCT")
+	for {
+		start := p.peek().pos
+		item := ReturnItem{Expr: p.expr()}
+		item.Name = strings.TrimSpace(p.input[start:p.peek().pos])
+		if p.accept("AS") {
+			item.Name = p.ident()
+		}
+		q.Return = append(q.Return, item)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if p.accept("ORDER") {
+		p.expect("BY")
+		for {
+			item := OrderItem{Expr: p.expr()}
+			if p.accept("DESC") {
+				item.Desc = true
+			} else {
+				p.accept("ASC")
+			}
+			q.OrderBy = append(q.OrderBy, item)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("SKIP") {
+		q.Skip = p.count()
+	}
+	if p.accept("LIMIT") {
+		q.Limit = p.count()
+	}
+	if t := p.next(); t.kind != tokEOF {
+		p.fail(t, "unexpected %v", t)
+	}
+	return q
+}
+
+// count reads the value of SKIP or LIMIT
+func (p *parser) count() Expr {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return Literal{Value: t.num}
+	case tokParam:
+		return Param{Name: t.text}
+	}
+	p.fail(t, "expecting a number or a parameter got %v", t)
+	return nil
+}
+
+func (p *parser) pattern() Pattern {
+	var pat Pattern
+	pat.Nodes = append(pat.Nodes, p.nodePattern())
+	for p.is("-") || p.is("<") {
+		pat.Rels = append(pat.Rels, p.relPattern())
+		pat.Nodes = append(pat.Nodes, p.nodePattern())
+	}
+	return pat
+}
+
+func (p *parser) nodePattern() NodePattern {
+	var n NodePattern
+	p.expect("(")
+	if p.peek().kind == tokIdent {
+		n.Var = p.ident()
+	}
+	for p.accept(":") {
+		n.Labels = append(n.Labels, p.ident())
+	}
+	if p.is("{") {
+		n.Props = p.properties()
+	}
+	p.expect(")")
+	return n
+}
+
+// relPattern reads -[...]->, <-[...]-, -[...]- and the short
+// forms -->, <-- and --
+func (p *parser) relPattern() RelPattern {
+	r := RelPattern{Dir: Either}
+	left := p.accept("<")
+	p.expect("-")
+	if p.accept("[") {
+		if p.peek().kind == tokIdent {
+			r.Var = p.ident()
+		}
+		if p.accept(":") {
+			r.Names = append(r.Names, p.ident())
+			for p.accept("|") {
+				p.accept(":")
+				r.Names = append(r.Names, p.ident())
+			}
+		}
+		if p.is("{") {
+			r.Props = p.properties()
+		}
+		p.expect("]")
+	}
+	t := p.expect("-")
+	right := p.accept(">")
+	switch {
+	case left && right:
+		p.fail(t, "a relation cannot point to both sides")
+	case left:
+		r.Dir = Left
+	case right:
+		r.Dir = Right
+	}
+	return r
+}
+
+func (p *parser) properties() []Property {
+	var out []Property
+	p.expect("{")
+	if p.accept("}") {
+		return out
+	}
+	for {
+		var prop Property
+		prop.Key = p.ident()
+		p.expect(":")
+		prop.Value = p.operand()
+		out = append(out, prop)
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect("}")
+	return out
+}
+
+func (p *parser) expr() Expr {
+	left := p.and()
+	for p.accept("OR") {
+		left = Binary{Op: "OR", Left: left, Right: p.and()}
+	}
+	return left
+}
+
+func (p *parser) and() Expr {
+	left := p.not()
+	for p.accept("AND") {
+		left = Binary{Op: "AND", Left: left, Right: p.not()}
+	}
+	return left
+}
+
+func (p *parser) not() Expr {
+	if p.accept("NOT") {
+		return Not{Expr: p.not()}
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() Expr {
+	left := p.operand()
+	if p.accept("IS") {
+		negated := p.accept("NOT")
+		p.expect("NULL")
+		return IsNull{Expr: left, Negated: negated}
+	}
+	for _, op := range []string{"=", "<>", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			return Binary{Op: op, Left: left, Right: p.operand()}
+		}
+	}
+	return left
+}
+
+func (p *parser) operand() Expr {
+	t := p.peek()
+	switch t.kind {
+	case tokString:
+		p.next()
+		return Literal{Value: t.text}
+	case tokNumber:
+		p.next()
+		return Literal{Value: t.num}
+	case tokParam:
+		p.next()
+		return Param{Name: t.text}
+	case tokKeyword:
+		switch t.text {
+		case "TRUE", "FALSE":
+			p.next()
+			return Literal{Value: t.text == "TRUE"}
+		case "NULL":
+			p.next()
+			return Literal{Value: nil}
+		}
+	case tokIdent:
+		p.next()
+		if p.accept("(") {
+			call := Call{Func: strings.ToLower(t.text)}
+			if !p.accept("*") {
+				call.Arg = p.expr()
+			}
+			p.expect(")")
+			return call
+		}
+		if !p.is(".") {
+			return Var{Name: t.text}
+		}
+		prop := Prop{Var: t.text}
+		for p.accept(".") {
+			prop.Path = append(prop.Path, p.ident())
+		}
+		return prop
+	case tokPunct:
+		switch t.text {
+		case "-":
+			p.next()
+			num := p.next()
+			if num.kind != tokNumber {
+				p.fail(num, "expecting a number after - got %v", num)
+			}
+			return Literal{Value: -num.num}
+		case "(":
+			// either a pattern (a)-->(b) or an expression between parenthesis
+			if pat, ok := p.tryPattern(); ok {
+				return Exists{Pattern: pat}
+			}
+			p.next()
+			e := p.expr()
+			p.expect(")")
+			return e
+		}
+	}
+	p.fail(t, "unexpected %v", t)
+	return nil
+}
+
+// tryPattern reads a pattern with at least one relation, if that isn't
+// possible the parser is restored to the initial position
+func (p *parser) tryPattern() (pat Pattern, ok bool) {
+	start := p.pos
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isSyntax := r.(*SyntaxError); !isSyntax {
+				panic(r)
+			}
+			p.pos = start
+			ok = false
+		}
+	}()
+	pat = p.pattern()
+	if len(pat.Rels) == 0 {
+		p.pos = start
+		return pat, false
+	}
+	return pat, true
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package lang
+
+import (
+	"fmt"
+)
+
+type (
+	// element is a node or a relation of the pattern graph
+	element struct {
+		alias string
+		rel   bool
+		// the variable that refers to the element, empty when anonymous
+		name   string
+		labels []string
+		props  []Property
+
+		// only for relations: the node before and after it in the pattern
+		a, b  *element
+		dir   Direction
+		names []string
+
+		// set while ordering the joins
+		joined bool
+	}
+
+	// scope holds the elements of a MATCH, or of a pattern inside WHERE
+	scope struct {
+		parent   *scope
+		vars     map[string]*element
+		elements []*element
+		// labels and properties added to elements of a parent scope
+		filters []filter
+	}
+
+	filter struct {
+		elem   *element
+		labels []string
+		props  []Property
+	}
+
+	// step is a table added to the FROM clause of the query, the first
+	// step of a component doesn't have a condition
+	step struct {
+		elem *element
+		on   []string
+	}
+)
+
+func newScope(parent *scope) *scope {
+	return &scope{parent: parent, vars: make(map[string]*element)}
+}
+
+// lookup finds a variable in this scope or in the parent scopes
+func (s *scope) lookup(name string) (*element, bool) {
+	for ; s != nil; s = s.parent {
+		if e, ok := s.vars[name]; ok {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// owns checks if e was created in this scope
+func (s *scope) owns(e *element) bool {
+	for _, own := range s.elements {
+		if own == e {
+			return true
+		}
+	}
+	return false
+}
+
+// bind adds the elements of the patterns to the scope. When allowNew is false
+// named variables must already exist in a parent scope.
+func (c *compiler) bind(sc *scope, patterns []Pattern, allowNew bool) {
+	for _, pat := range patterns {
+		if len(pat.Rels) != len(pat.Nodes)-1 {
+			c.fail("pattern must have one relation between each pair of nodes")
+		}
+		nodes := make([]*element, len(pat.Nodes))
+		for i, np := range pat.Nodes {
+			e := c.bindElement(sc, np.Var, false, allowNew)
+			if sc.owns(e) {
+				e.labels = append(e.labels, np.Labels...)
+				e.props = append(e.props, np.Props...)
+			} else if len(np.Labels) > 0 || len(np.Props) > 0 {
+				sc.filters = append(sc.filters, filter{elem: e, labels: np.Labels, props: np.Props})
+			}
+			nodes[i] = e
+		}
+		for i, rp := range pat.Rels {
+			if len(rp.Var) > 0 {
+				if e, exists := sc.lookup(rp.Var); exists && e.rel {
+					c.fail("relation variable %v is used twice", rp.Var)
+				}
+			}
+			e := c.bindElement(sc, rp.Var, true, allowNew)
+			e.a, e.b = nodes[i], nodes[i+1]
+			e.dir = rp.Dir
+			e.names = rp.Names
+			e.props = rp.Props
+		}
+	}
+}
+
+func (c *compiler) bindElement(sc *scope, name string, rel, allowNew bool) *element {
+	if len(name) > 0 {
+		if e, ok := sc.lookup(name); ok {
+			if e.rel != rel {
+				c.fail("%v cannot be both a node and a relation", name)
+			}
+			return e
+		}
+		if !allowNew {
+			c.fail("%v is not defined, patterns inside WHERE cannot introduce variables", name)
+		}
+	}
+	e := &element{rel: rel, name: name}
+	if rel {
+		e.alias = c.alias("r")
+	} else {
+		e.alias = c.alias("n")
+	}
+	if len(name) > 0 {
+		sc.vars[name] = e
+	}
+	sc.elements = append(sc.elements, e)
+	return e
+}
+
+// joinOrder decides the order of the tables in the FROM clause. It starts with
+// the most selective node and follows the relations, so every join has a condition.
+// The elements of parent scopes are considered already joined.
+func (c *compiler) joinOrder(sc *scope) []step {
+	var steps []step
+	var queue []*element
+	join := func(e *element, on []string) {
+		e.joined = true
+		steps = append(steps, step{elem: e, on: on})
+		if !e.rel {
+			queue = append(queue, e)
+		}
+	}
+	isJoined := func(e *element) bool {
+		// elements from the parent scope are always available
+		return e.joined || !sc.owns(e)
+	}
+
+	// relations from nodes of the parent scope come first
+	var outer []*element
+	for _, e := range sc.elements {
+		if e.rel && (isJoined(e.a) || isJoined(e.b)) {
+			outer = append(outer, e)
+		}
+	}
+
+	for {
+		// follow the relations from the nodes already joined
+		for len(queue) > 0 || len(outer) > 0 {
+			var rels []*element
+			if len(outer) > 0 {
+				rels, outer = outer, nil
+			} else {
+				node := queue[0]
+				queue = queue[1:]
+				for _, e := range sc.elements {
+					if e.rel && !e.joined && (e.a == node || e.b == node) {
+						rels = append(rels, e)
+					}
+				}
+			}
+			for _, rel := range rels {
+				if rel.joined {
+					continue
+				}
+				from, to := rel.a, rel.b
+				if !isJoined(from) {
+					from, to = to, from
+				}
+				join(rel, relJoin(rel, from, to, isJoined(to)))
+				if !isJoined(to) {
+					join(to, []string{fmt.Sprintf("%v.gid = %v", to.alias, otherEnd(rel, from))})
+				}
+			}
+		}
+		// start a new component with the most selective node left
+		var best *element
+		for _, e := range sc.elements {
+			if !e.rel && !e.joined && (best == nil || selectivity(e) > selectivity(best)) {
+				best = e
+			}
+		}
+		if best == nil {
+			break
+		}
+		join(best, nil)
+	}
+	// relations between nodes of the parent scope
+	for _, e := range sc.elements {
+		if e.rel && !e.joined {
+			join(e, relJoin(e, e.a, e.b, true))
+		}
+	}
+	return steps
+}
+
+// relJoin returns the conditions to join rel from the node from, and also
+// to the node to when it is already joined
+func relJoin(rel, from, to *element, toJoined bool) []string {
+	var on []string
+	if rel.dir == Either {
+		on = append(on, fmt.Sprintf("(%v.from_ = %v.gid or %v.to_ = %v.gid)", rel.alias, from.alias, rel.alias, from.alias))
+	} else {
+		on = append(on, fmt.Sprintf("%v = %v.gid", endColumn(rel, from), from.alias))
+	}
+	if toJoined {
+		on = append(on, fmt.Sprintf("%v = %v.gid", otherEnd(rel, from), to.alias))
+	}
+	return on
+}
+
+// endColumn is the column of rel that holds the node n
+func endColumn(rel, n *element) string {
+	// the node before the relation in the pattern is the source of Right
+	if (rel.dir == Right) == (n == rel.a) {
+		return rel.alias + ".from_"
+	}
+	return rel.alias + ".to_"
+}
+
+// otherEnd is the expression with the gid of the node at the other end
+// of rel, starting from n
+func otherEnd(rel, n *element) string {
+	if rel.dir == Either {
+		return fmt.Sprintf("(case when %v.from_ = %v.gid then %v.to_ else %v.from_ end)", rel.alias, n.alias, rel.alias, rel.alias)
+	}
+	if endColumn(rel, n) == rel.alias+".from_" {
+		return rel.alias + ".to_"
+	}
+	return rel.alias + ".from_"
+}
+
+// selectivity estimates how few rows a node pattern matches
+func selectivity(e *element) int {
+	for _, p := range e.props {
+		if p.Key == "name" {
+			return 3
+		}
+	}
+	if len(e.props) > 0 {
+		return 2
+	}
+	if len(e.labels) > 0 {
+		return 1
+	}
+	return 0
+}
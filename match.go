@@ -0,0 +1,188 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/andrebq/ograph/lang"
+)
+
+type (
+	// A small graph searched by G.Match. Every node variable is bound to a
+	// different node, so a Pattern finds the subgraphs isomorphic to it.
+	Pattern struct {
+		Nodes     []PatternNode
+		Relations []PatternRelation
+		// 0 returns all the matches
+		Limit int
+	}
+
+	// A node variable of a Pattern. Variables used by relations but
+	// not listed in Pattern.Nodes match any node.
+	PatternNode struct {
+		Var    string
+		Labels []string
+		// when set, the node must have this name
+		Name string
+		// when set, the variable is bound to this node
+		Ref NodeRef
+	}
+
+	// A relation between two node variables. An empty Name matches any
+	// relation, Not requires that no such relation exists.
+	PatternRelation struct {
+		From string
+		Name string
+		To   string
+		Not  bool
+	}
+
+	// The nodes bound to each variable of a Pattern
+	Binding map[string]*Node
+)
+
+// Match returns every binding of the pattern variables to nodes
+// of the graph, once even when there are parallel relations, eg.: friends
+// of friends that aren't friends yet
+//
+//	g.Match(Pattern{
+//		Relations: []PatternRelation{
+//			{From: "a", Name: "knows", To: "b"},
+//			{From: "b", Name: "knows", To: "c"},
+//			{From: "a", Name: "knows", To: "c", Not: true},
+//		},
+//	})
+func (g *G) Match(p Pattern) (_ []Binding, err error) {
+	defer g.returnError(&err)
+	q, vars, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := lang.Compile(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out []Binding
+	err = g.repo.QueryEach(compiled.SQL, compiled.Args, func(rows *sql.Rows) error {
+		row, err := scanResult(rows, compiled.Columns)
+		if err != nil {
+			return err
+		}
+		b := make(Binding, len(vars))
+		for i, v := range vars {
+			b[v] = row[i].(*Node)
+		}
+		out = append(out, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// query converts the pattern to the AST of the lang package, returns the
+// variables in the order they are returned by the query
+func (p Pattern) query() (*lang.Query, []string, error) {
+	// parallel relations (see RelationRule.Multi) would repeat the bindings
+	q := &lang.Query{Distinct: true}
+	var vars []string
+	nodes := make(map[string]*lang.NodePattern)
+	var conds []lang.Expr
+	and := func(e lang.Expr) {
+		conds = append(conds, e)
+	}
+	declare := func(v string) (*lang.NodePattern, error) {
+		if len(v) == 0 {
+			return nil, fmt.Errorf("pattern variables must have a name")
+		}
+		if np, ok := nodes[v]; ok {
+			return np, nil
+		}
+		np := &lang.NodePattern{Var: v}
+		nodes[v] = np
+		vars = append(vars, v)
+		return np, nil
+	}
+	for _, n := range p.Nodes {
+		np, err := declare(n.Var)
+		if err != nil {
+			return nil, nil, err
+		}
+		np.Labels = append(np.Labels, n.Labels...)
+		if len(n.Name) > 0 {
+			np.Props = append(np.Props, lang.Property{Key: "name", Value: lang.Literal{Value: n.Name}})
+		}
+		if n.Ref != nil {
+			and(lang.Binary{Op: "=", Left: lang.Call{Func: "id", Arg: lang.Var{Name: n.Var}},
+				Right: lang.Literal{Value: uint64(n.Ref.Identity().Gid)}})
+		}
+	}
+	related := make(map[string]bool)
+	for _, r := range p.Relations {
+		for _, v := range []string{r.From, r.To} {
+			if _, err := declare(v); err != nil {
+				return nil, nil, err
+			}
+		}
+		rel := lang.Pattern{
+			Nodes: []lang.NodePattern{{Var: r.From}, {Var: r.To}},
+			Rels:  []lang.RelPattern{{Dir: lang.Right}},
+		}
+		if len(r.Name) > 0 {
+			rel.Rels[0].Names = []string{r.Name}
+		}
+		if r.Not {
+			and(lang.Not{Expr: lang.Exists{Pattern: rel}})
+			continue
+		}
+		related[r.From], related[r.To] = true, true
+		q.Match = append(q.Match, rel)
+	}
+	if len(vars) == 0 {
+		return nil, nil, fmt.Errorf("empty pattern")
+	}
+	// the labels and name filters are applied once, on a node of their own
+	for _, v := range vars {
+		if np := nodes[v]; !related[v] || len(np.Labels) > 0 || len(np.Props) > 0 {
+			q.Match = append(q.Match, lang.Pattern{Nodes: []lang.NodePattern{*np}})
+		}
+	}
+	for i, v := range vars {
+		q.Return = append(q.Return, lang.ReturnItem{Expr: lang.Var{Name: v}, Name: v})
+		q.OrderBy = append(q.OrderBy, lang.OrderItem{Expr: lang.Var{Name: v}})
+		for _, other := range vars[:i] {
+			and(lang.Binary{Op: "<>", Left: lang.Call{Func: "id", Arg: lang.Var{Name: other}},
+				Right: lang.Call{Func: "id", Arg: lang.Var{Name: v}}})
+		}
+	}
+	for _, c := range conds {
+		if q.Where == nil {
+			q.Where = c
+		} else {
+			q.Where = lang.Binary{Op: "AND", Left: q.Where, Right: c}
+		}
+	}
+	if p.Limit > 0 {
+		q.Limit = lang.Literal{Value: float64(p.Limit)}
+	}
+	return q, vars, nil
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"github.com/andrebq/ograph/data"
+)
+
+// Metrics returns the metrics collected by the Repo, they are created the
+// first time Metrics is called. The handler can be mounted by the services:
+//
+//	http.Handle("/metrics", g.Metrics().Handler())
+//
+// Besides the counters of the Repo, the ApiError values returned by G are
+// counted by kind, see ApiError.Kind.
+func (g *G) Metrics() *data.Metrics {
+	if g.repo.Metrics == nil {
+		g.repo.Metrics = data.NewMetrics(nil)
+	}
+	return g.repo.Metrics
+}
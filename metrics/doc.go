@@ -0,0 +1,2 @@
+// metrics implements counters and histograms that are served in the Prometheus text format
+package metrics
@@ -0,0 +1,320 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Registry keeps the counters and histograms and writes them in the
+	// Prometheus text format. It is a http.Handler, so it can be mounted
+	// directly, usually at /metrics.
+	Registry struct {
+		lock    sync.Mutex
+		metrics []metric
+		names   map[string]bool
+	}
+
+	// Counter is a value that only goes up. When it was created with label
+	// names, each call must pass one value for each label.
+	Counter struct {
+		family
+		values map[string]*float64
+	}
+
+	// Histogram counts observations in cumulative buckets, and also
+	// keeps their sum and count
+	Histogram struct {
+		family
+		buckets []float64
+		values  map[string]*histogramValue
+	}
+
+	histogramValue struct {
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+
+	family struct {
+		lock   sync.Mutex
+		name   string
+		help   string
+		labels []string
+		// label values of the series with a value, by key
+		series map[string][]string
+	}
+
+	metric interface {
+		write(w *bufio.Writer)
+	}
+)
+
+// DefaultBuckets are the buckets used by Prometheus clients for latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Counter creates a counter, it panics if name was already used
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, labels), values: make(map[string]*float64)}
+	r.register(name, c)
+	return c
+}
+
+// Histogram creates a histogram with the given upper bounds, which must be sorted.
+// A nil buckets uses DefaultBuckets. It panics if name was already used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %v aren't sorted", name))
+	}
+	h := &Histogram{
+		family:  newFamily(name, help, labels),
+		buckets: append([]float64(nil), buckets...),
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(name, h)
+	return h
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %v is already registered", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the Prometheus text format, in the order
+// they were created
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// String returns the output of WriteTo
+func (r *Registry) String() string {
+	var sb strings.Builder
+	r.WriteTo(&sb)
+	return sb.String()
+}
+
+// ServeHTTP writes the metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter, it panics if v is negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: cannot decrease counter %v", c.name))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	k := c.key(labelValues)
+	p, ok := c.values[k]
+	if !ok {
+		p = new(float64)
+		c.values[k] = p
+		c.series[k] = append([]string(nil), labelValues...)
+	}
+	*p += v
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if p, ok := c.values[c.key(labelValues)]; ok {
+		return *p
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.header(w, "counter")
+	for _, k := range c.keys() {
+		c.sample(w, c.name, c.series[k], "", "", *c.values[k])
+	}
+}
+
+// Observe adds v to the histogram
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	k := h.key(labelValues)
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+		h.series[k] = append([]string(nil), labelValues...)
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// Count returns the number of observations and their sum
+func (h *Histogram) Count(labelValues ...string) (count uint64, sum float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if hv, ok := h.values[h.key(labelValues)]; ok {
+		return hv.count, hv.sum
+	}
+	return 0, 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.header(w, "histogram")
+	for _, k := range h.keys() {
+		hv := h.values[k]
+		values := h.series[k]
+		for i, upper := range h.buckets {
+			h.sample(w, h.name+"_bucket", values, "le", formatFloat(upper), float64(hv.counts[i]))
+		}
+		h.sample(w, h.name+"_bucket", values, "le", "+Inf", float64(hv.count))
+		h.sample(w, h.name+"_sum", values, "", "", hv.sum)
+		h.sample(w, h.name+"_count", values, "", "", float64(hv.count))
+	}
+}
+
+func newFamily(name, help string, labels []string) family {
+	return family{
+		name:   name,
+		help:   help,
+		labels: append([]string(nil), labels...),
+		series: make(map[string][]string),
+	}
+}
+
+// key identifies the series with the given label values
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %v expects %v label values got %v", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// keys returns the keys of the series sorted by their label values
+func (f *family) keys() []string {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *family) header(w *bufio.Writer, kind string) {
+	if len(f.help) > 0 {
+		fmt.Fprintf(w, "# HELP %v %v\n", f.name, helpEscaper.Replace(f.help))
+	}
+	fmt.Fprintf(w, "# TYPE %v %v\n", f.name, kind)
+}
+
+// sample writes one line, extraName and extraValue are used by the
+// le label of the histogram buckets
+func (f *family) sample(w *bufio.Writer, name string, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(values) > 0 || len(extraName) > 0 {
+		w.WriteByte('{')
+		for i, label := range f.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", label, labelEscaper.Replace(values[i]))
+		}
+		if len(extraName) > 0 {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
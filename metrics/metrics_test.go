@@ -0,0 +1,113 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("ograph_writes_total", "Writes by kind", "kind")
+	c.Inc("node")
+	c.Add(2, "relation")
+	c.Inc("node")
+	plain := reg.Counter("ograph_walks_total", "")
+	plain.Inc()
+
+	if v := c.Value("missing"); v != 0 {
+		t.Errorf("expecting %v got %v", 0, v)
+	}
+	if v := c.Value("node"); v != 2 {
+		t.Errorf("expecting %v got %v", 2, v)
+	}
+	expected := `# HELP ograph_writes_total Writes by kind
+# TYPE ograph_writes_total counter
+ograph_writes_total{kind="node"} 2
+ograph_writes_total{kind="relation"} 2
+# TYPE ograph_walks_total counter
+ograph_walks_total 1
+`
+	if out := reg.String(); out != expected {
+		t.Errorf("expecting\n%v\ngot\n%v", expected, out)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	reg := NewRegistry()
+	h := reg.Histogram("ograph_walk_rows", "Rows by walk", []float64{1, 10}, "name")
+	h.Observe(0, "knows")
+	h.Observe(5, "knows")
+	h.Observe(50, "knows")
+
+	if count, sum := h.Count("knows"); count != 3 || sum != 55 {
+		t.Errorf("expecting 3 and 55 got %v and %v", count, sum)
+	}
+	expected := `# HELP ograph_walk_rows Rows by walk
+# TYPE ograph_walk_rows histogram
+ograph_walk_rows_bucket{name="knows",le="1"} 1
+ograph_walk_rows_bucket{name="knows",le="10"} 2
+ograph_walk_rows_bucket{name="knows",le="+Inf"} 3
+ograph_walk_rows_sum{name="knows"} 55
+ograph_walk_rows_count{name="knows"} 3
+`
+	if out := reg.String(); out != expected {
+		t.Errorf("expecting\n%v\ngot\n%v", expected, out)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("ograph_errors_total", "Errors\nby kind", "kind")
+	c.Inc(`say "hi"\`)
+	expected := `# HELP ograph_errors_total Errors\nby kind
+# TYPE ograph_errors_total counter
+ograph_errors_total{kind="say \"hi\"\\"} 1
+`
+	if out := reg.String(); out != expected {
+		t.Errorf("expecting\n%v\ngot\n%v", expected, out)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("ograph_walks_total", "Walks").Inc()
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "ograph_walks_total 1\n") {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("ograph_walks_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expecting a panic")
+		}
+	}()
+	reg.Histogram("ograph_walks_total", "", nil)
+}
@@ -20,8 +20,13 @@
 package ograph
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
 	"github.com/andrebq/ograph/data"
+	"github.com/andrebq/ograph/schema"
+	"github.com/andrebq/ograph/trace"
 )
 
 type (
@@ -32,6 +37,9 @@ type (
 		Attributes Attributes
 		Gid        Nid
 		Name       string
+		// Labels are kept sorted and without duplicates. Saving a node with
+		// nil Labels keeps the ones already stored, an empty slice removes them.
+		Labels []string
 	}
 
 	// Identity is used to allow other apis to refer to a given node
@@ -40,12 +48,106 @@ type (
 		Gid Nid
 	}
 
+	// NodeRef refers to a node without loading it, implemented
+	// by *Node, Identity and Nid
+	NodeRef interface {
+		Identity() Identity
+	}
+
+	// Upsert saves Node reusing the node with the same name, if any,
+	// instead of failing on the unique name constraint
+	Upsert struct {
+		Node *Node
+		Mode UpsertMode
+	}
+
+	// Controls what an Upsert does with the attributes of a node that already exists
+	UpsertMode int
+
 	// A connection between two nodes
 	Relation struct {
 		From       *Node
 		To         *Node
 		Name       string
 		Attributes Attributes
+		// Set by SaveAll, a Relation with Rid is updated instead of created
+		Rid Rid
+	}
+
+	// A relation name and how many relations are using it
+	RelationName struct {
+		Name  string
+		Count int64
+	}
+
+	// Constrains the relations with a given name, checked every time
+	// one of those relations is saved
+	RelationRule struct {
+		Name        string
+		Cardinality Cardinality
+		NoSelfLoops bool
+		// Allows many relations with this name between the same two nodes,
+		// every SaveAll of a new Relation creates another one
+		Multi bool
+
+		// sql LIKE patterns for the names of the endpoints, empty allows any node
+		FromPattern string
+		ToPattern   string
+	}
+
+	// Returned by SaveAll when a relation breaks the RelationRule of its name
+	RuleError struct {
+		Name     string
+		From, To Nid
+		Reason   string
+	}
+
+	// Limits how many relations with the same name a node can have
+	Cardinality int
+
+	// Restricts the relations returned by WalkWith
+	WalkOptions struct {
+		// only relations to nodes with all those labels
+		ToLabels []string
+
+		// Reads the relations in pages of Limit relations ordered by Rid,
+		// After is the Cursor of the previous page
+		Limit int
+		After Rid
+
+		// Sorts the relations, cannot be used with After
+		OrderBy []Order
+		Offset  int
+	}
+
+	// Sorts the relations returned by a walk, see ByTargetName,
+	// ByTargetAttribute and ByRelationAttribute
+	Order struct {
+		by         data.OrderField
+		path       []string
+		Descending bool
+	}
+
+	// A node and how many relations start (Out) or end (In) on it
+	NodeDegree struct {
+		Node *Node
+		Out  int64
+		In   int64
+	}
+
+	// A relation checked by HasRelations
+	RelationCheck struct {
+		From NodeRef
+		Name string
+		To   NodeRef
+	}
+
+	// Counters for the whole graph
+	Summary struct {
+		Nodes     int64
+		Relations []RelationName
+		// the nodes with more relations, in any direction
+		TopNodes []NodeDegree
 	}
 
 	// The attributes of a Node or Relation
@@ -54,16 +156,44 @@ type (
 	// A Nid holds the information used to identify a node
 	Nid uint64
 
+	// A Rid identifies a relation
+	Rid uint64
+
 	// The object graph
 	G struct {
 		repo *data.Repo
+
+		// schemas for the attributes, by node label and by relation name,
+		// loaded from the database the first time they are needed.
+		// The maps are replaced, never changed, see setSchema.
+		schemaLock      sync.RWMutex
+		schemasLoaded   bool
+		nodeSchemas     map[string]*schema.Schema
+		relationSchemas map[string]*schema.Schema
+
+		// see Trace
+		tracer     trace.Tracer
+		parentSpan trace.Span
+		activeSpan trace.Span
+		traceHook  *tracingHook
 	}
 
-	// A query used to walk the graph
+	// A query used to walk the graph, built by G.Query and the
+	// steps of query.go
 	Query struct {
-		g *G
-		nodes []*Node
-		err error
+		g     *G
+		start []uint64
+		steps []data.Step
+		// the names given by As, in order
+		marks []string
+		err   error
+	}
+
+	// A path walked by a Query, Rids[i] is the relation between
+	// Nodes[i] and Nodes[i+1]
+	Path struct {
+		Nodes []*Node
+		Rids  []Rid
 	}
 
 	// Represents an error
@@ -73,14 +203,62 @@ type (
 	Predicate func(*Relation) bool
 )
 
-func (n *Node) Rel(object string, predicate *Node) *Relation {
+func (n *Node) Rel(object string, predicate NodeRef) *Relation {
 	return &Relation{
 		From: n,
-		To: predicate,
+		To: refNode(predicate),
 		Name: object,
 	}
 }
 
+// Identity implements NodeRef
+func (n *Node) Identity() Identity {
+	if n == nil {
+		return Identity{}
+	}
+	return Identity{Gid: n.Gid}
+}
+
+// Identity implements NodeRef
+func (i Identity) Identity() Identity {
+	return i
+}
+
+// Identity implements NodeRef
+func (n Nid) Identity() Identity {
+	return Identity{Gid: n}
+}
+
+// Rel returns a relation from one node to the other, unlike Node.Rel
+// the endpoints can be any NodeRef, so an Identity or a Nid is enough
+func Rel(from NodeRef, name string, to NodeRef) *Relation {
+	return &Relation{
+		From: refNode(from),
+		To:   refNode(to),
+		Name: name,
+	}
+}
+
+// refNode returns the *Node behind ref, other references become
+// a Node with only the Gid
+func refNode(ref NodeRef) *Node {
+	if ref == nil {
+		return nil
+	}
+	if n, ok := ref.(*Node); ok {
+		return n
+	}
+	return &Node{Gid: ref.Identity().Gid}
+}
+
+// Upsert returns a value that SaveAll saves by name using the given mode
+func (n *Node) Upsert(mode UpsertMode) *Upsert {
+	return &Upsert{
+		Node: n,
+		Mode: mode,
+	}
+}
+
 func (n *Node) Is(other interface{}) bool {
 	if n == nil {
 		return false
@@ -94,6 +272,8 @@ func (n *Node) Is(other interface{}) bool {
 		return n.Gid == other.Gid
 	case *Node:
 		return n.Gid == other.Gid
+	case NodeRef:
+		return n.Gid == other.Identity().Gid
 	default:
 		return false
 	}
@@ -106,11 +286,24 @@ func (p Predicate) Valid(r *Relation) bool {
 	return p(r)
 }
 
+// Kind returns the name of the error used as a metric label, eg.: not_found
+func (a ApiError) Kind() string {
+	if kind, ok := errorKinds[a]; ok {
+		return kind
+	}
+	return "other"
+}
+
 // Error implements the error interface
 func (a ApiError) Error() string {
 	return string(a)
 }
 
+// Error implements the error interface
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("relation %q from %v to %v: %v", e.Name, e.From, e.To, e.Reason)
+}
+
 const (
 	// ErrNotFound: Unable to find a Node or Relation in the graph
 	ErrNotFound = ApiError("not found")
@@ -120,18 +313,80 @@ const (
 
 	ErrAbortedByUser = ApiError("user aborted the transaction")
 
+	// ErrRelationNameExists: Cannot rename a relation to a name that is already used
+	ErrRelationNameExists = ApiError("relation name already exists")
+
+	// ErrRelationNameInUse: Cannot delete a relation name while relations are using it
+	ErrRelationNameInUse = ApiError("relation name is in use")
+
+	// ErrInvalidStep: A Query step was used where it isn't allowed, eg.: As inside Repeat
+	ErrInvalidStep = ApiError("invalid query step")
+
 	// A Invalid Node id
 	InvalidNid = Nid(0)
+
+	// A Invalid Relation id
+	InvalidRid = Rid(0)
+)
+
+// the kinds of ApiError used by the metrics, see ApiError.Kind
+var errorKinds = map[ApiError]string{
+	ErrNotFound:           "not_found",
+	ErrInvalidEncoding:    "invalid_encoding",
+	ErrAbortedByUser:      "aborted_by_user",
+	ErrRelationNameExists: "relation_name_exists",
+	ErrRelationNameInUse:  "relation_name_in_use",
+	ErrInvalidStep:        "invalid_step",
+}
+
+const (
+	// No limits
+	ManyToMany = Cardinality(data.ManyToMany)
+	// At most one outgoing relation per node
+	ManyToOne = Cardinality(data.ManyToOne)
+	// At most one incoming relation per node
+	OneToMany = Cardinality(data.OneToMany)
+	// At most one outgoing and one incoming relation per node
+	OneToOne = Cardinality(data.OneToOne)
+)
+
+const (
+	// KeepAttributes ignores the attributes of the Upsert when the node already exists
+	KeepAttributes = UpsertMode(data.UpsertKeep)
+	// MergeAttributes adds the top-level attributes of the Upsert to the existing ones
+	MergeAttributes = UpsertMode(data.UpsertMerge)
+	// ReplaceAttributes overwrites the existing attributes with the ones from the Upsert
+	ReplaceAttributes = UpsertMode(data.UpsertReplace)
 )
 
 func (g *G) Use(repo *data.Repo) {
+	traced := g.traceHook != nil
+	g.detachTraceHook()
 	g.repo = repo
+	if traced {
+		g.attachTraceHook()
+	}
 }
 
-func (g *G) SaveAll(what ...interface{}) error {
+// SaveAll saves nodes, upserts and relations in a single transaction.
+//
+// Nodes are saved before relations, so a relation can use nodes from the
+// same call. Relation endpoints without Gid are found by name and created
+// if they don't exist.
+func (g *G) SaveAll(what ...interface{}) (err error) {
+	span, end := g.startSpan("ograph.SaveAll")
+	defer func() {
+		traceSaved(span, what)
+		end(err)
+	}()
+	defer g.returnError(&err)
+	span.SetAttribute("ograph.objects", len(what))
+	if err := g.validate(what); err != nil {
+		return err
+	}
 	g.repo.Begin()
 	defer g.repo.End()
-	for _, v := range what {
+	for _, v := range dependencyOrder(what) {
 		err := g.save(v)
 		if err != nil {
 			return err
@@ -144,11 +399,29 @@ func (g *G) save(what interface{}) error {
 	switch what := what.(type) {
 	case *Node:
 		return g.saveNode(what)
+	case *Upsert:
+		return g.upsertNode(what)
 	case *Relation:
 		return g.saveRelation(what)
 	default:
-		return fmt.Errorf("cannot save %#q", what)
+		return g.repo.Abort(fmt.Errorf("cannot save %#q", what))
+	}
+}
+
+// dependencyOrder moves the relations after everything else
+func dependencyOrder(what []interface{}) []interface{} {
+	ordered := make([]interface{}, 0, len(what))
+	for _, v := range what {
+		if _, ok := v.(*Relation); !ok {
+			ordered = append(ordered, v)
+		}
 	}
+	for _, v := range what {
+		if _, ok := v.(*Relation); ok {
+			ordered = append(ordered, v)
+		}
+	}
+	return ordered
 }
 
 func (g *G) saveNode(n *Node) error {
@@ -156,26 +429,99 @@ func (g *G) saveNode(n *Node) error {
 	node.Gid = uint64(n.Gid)
 	node.Name = n.Name
 	node.Attributes = string(n.Attributes)
+	node.Labels = n.Labels
+	keptLabels := n.Labels == nil && n.Gid != InvalidNid
 	g.repo.SaveNode(&node)
 	n.Gid = Nid(node.Gid)
 	n.Attributes = Attributes(node.Attributes)
-	return g.repo.Err()
+	n.Labels = node.Labels
+	if g.repo.Err() != nil || !keptLabels {
+		return g.repo.Err()
+	}
+	// validate skipped the node, its stored labels are only known now
+	return g.validateWritten(n)
+}
+
+func (g *G) upsertNode(u *Upsert) error {
+	var node data.Node
+	node.Name = u.Node.Name
+	node.Attributes = string(u.Node.Attributes)
+	node.Labels = u.Node.Labels
+	g.repo.UpsertNode(&node, data.UpsertMode(u.Mode))
+	u.Node.Gid = Nid(node.Gid)
+	u.Node.Attributes = Attributes(node.Attributes)
+	u.Node.Labels = node.Labels
+	if g.repo.Err() != nil {
+		return g.repo.Err()
+	}
+	// only now the merged attributes and labels are known
+	return g.validateWritten(u.Node)
+}
+
+// validateWritten checks a node after it is written, the transaction is
+// aborted when the node doesn't pass
+func (g *G) validateWritten(n *Node) error {
+	var violations []Violation
+	if err := g.validateNode(n, &violations); err != nil {
+		return g.repo.Abort(err)
+	}
+	if len(violations) > 0 {
+		return g.repo.Abort(&ValidationError{Violations: violations})
+	}
+	return nil
 }
 
 func (g *G) saveRelation(r *Relation) error {
+	if err := g.resolveEndpoint(r.From); err != nil {
+		return err
+	}
+	if err := g.resolveEndpoint(r.To); err != nil {
+		return err
+	}
 	var rel data.Relation
 	rel.FromGid = uint64(r.From.Gid)
 	rel.ToGid = uint64(r.To.Gid)
 	rel.Attributes = string(r.Attributes)
 	rel.Name = r.Name
+	rel.Rid = uint64(r.Rid)
 
 	g.repo.SaveRelation(&rel)
 	r.Attributes = Attributes(rel.Attributes)
+	r.Rid = Rid(rel.Rid)
 	return g.repo.Err()
 }
 
-func (g *G) Node(id Nid, name string, out *Node) (*Node, error) {
+// resolveEndpoint gives a Gid to a relation endpoint that only has a name,
+// the node is created if it doesn't exist
+func (g *G) resolveEndpoint(n *Node) error {
+	if n == nil {
+		return g.repo.Abort(errors.New("relation endpoints are required"))
+	}
+	if n.Gid != InvalidNid {
+		return nil
+	}
+	if len(n.Name) == 0 {
+		return g.repo.Abort(errors.New("relation endpoints must have a Gid or a Name"))
+	}
+	return g.upsertNode(n.Upsert(KeepAttributes))
+}
+
+// Node loads the node referred by ref or, when ref doesn't have a Gid, by name.
+// ErrNotFound is returned when the node doesn't exist.
+func (g *G) Node(ref NodeRef, name string, out *Node) (_ *Node, err error) {
+	span, end := g.startSpan("ograph.Node")
+	defer func() { end(err) }()
+	defer g.returnError(&err)
 	var tmpOut data.Node
+	var id Nid
+	if ref != nil {
+		id = ref.Identity().Gid
+		if n, ok := ref.(*Node); ok && id == InvalidNid && len(name) == 0 {
+			name = n.Name
+		}
+	}
+	span.SetAttribute("ograph.node_id", uint64(id))
+	span.SetAttribute("ograph.node_name", name)
 	if err := g.repo.FetchNode(name, uint64(id), &tmpOut); err != nil {
 		return nil, err
 	}
@@ -185,14 +531,259 @@ func (g *G) Node(id Nid, name string, out *Node) (*Node, error) {
 	out.Gid = Nid(tmpOut.Gid)
 	out.Name = tmpOut.Name
 	out.Attributes = Attributes(tmpOut.Attributes)
+	out.Labels = tmpOut.Labels
+	return out, nil
+}
+
+// Relation loads the relation identified by id, the From and To nodes
+// are loaded as well
+func (g *G) Relation(id Rid, out *Relation) (_ *Relation, err error) {
+	defer g.returnError(&err)
+	var raw data.Relation
+	if err := g.repo.FetchRelationByRid(uint64(id), &raw); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	rel := relationSet(data.RelationSet{&raw})[0]
+	if out == nil {
+		return rel, nil
+	}
+	*out = *rel
+	return out, nil
+}
+
+// RelationBetween loads the relation with the given name from one node to the other,
+// with its From and To nodes. When there are many of them (see RelationRule.Multi)
+// the oldest one is returned.
+func (g *G) RelationBetween(from NodeRef, name string, to NodeRef) (_ *Relation, err error) {
+	defer g.returnError(&err)
+	var raw data.Relation
+	err = g.repo.FetchRelation(uint64(from.Identity().Gid), uint64(to.Identity().Gid), name, &raw)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return relationSet(data.RelationSet{&raw})[0], nil
+}
+
+// DeleteAll removes nodes (any NodeRef) and relations (*Relation or Rid) in a
+// single transaction. Removing a node also removes its relations.
+// A *Relation without Rid removes every relation with its name between its nodes.
+func (g *G) DeleteAll(what ...interface{}) (err error) {
+	defer g.returnError(&err)
+	g.repo.Begin()
+	defer g.repo.End()
+	for _, v := range what {
+		if err := g.delete(v); err != nil {
+			return err
+		}
+	}
+	return g.repo.Err()
+}
+
+func (g *G) delete(what interface{}) error {
+	var rel data.Relation
+	switch what := what.(type) {
+	case Rid:
+		rel.Rid = uint64(what)
+	case *Relation:
+		rel.Rid = uint64(what.Rid)
+		if what.Rid != InvalidRid {
+			break
+		}
+		if what.From == nil || what.To == nil {
+			return g.repo.Abort(errors.New("a relation without Rid needs its From and To nodes"))
+		}
+		rel.FromGid = uint64(what.From.Gid)
+		rel.ToGid = uint64(what.To.Gid)
+		rel.Name = what.Name
+	case NodeRef:
+		return g.repo.DeleteNode(uint64(what.Identity().Gid))
+	default:
+		return g.repo.Abort(fmt.Errorf("cannot delete %#v", what))
+	}
+	return g.repo.DeleteRelation(&rel)
+}
+
+// NodesWithLabel returns all nodes that have every one of the given labels
+func (g *G) NodesWithLabel(labels ...string) (_ []*Node, err error) {
+	defer g.returnError(&err)
+	raw, err := g.repo.NodesWithLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Node, len(raw))
+	for i := range raw {
+		out[i] = nodeFromData(&raw[i])
+	}
 	return out, nil
 }
 
-func (g *G) Walk(from *Node, using string) (RelationSet, error) {
-	raw, err := g.repo.Walk(uint64(from.Gid), using, nil)
+// Nodes loads many nodes with a single query. The nodes are returned in the
+// same order as ids, the ids that weren't found are returned in missing.
+func (g *G) Nodes(ids []Nid) (found []*Node, missing []Nid, err error) {
+	defer g.returnError(&err)
+	gids := make([]uint64, len(ids))
+	for i, id := range ids {
+		gids[i] = uint64(id)
+	}
+	raw, err := g.repo.FetchNodes(gids)
+	if err != nil {
+		return nil, nil, err
+	}
+	byGid := make(map[Nid]*Node, len(raw))
+	for i := range raw {
+		n := nodeFromData(&raw[i])
+		byGid[n.Gid] = n
+	}
+	for _, id := range ids {
+		if n, ok := byGid[id]; ok {
+			found = append(found, n)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing, nil
+}
+
+// NodesByName works like Nodes but finds the nodes by name
+func (g *G) NodesByName(names []string) (found []*Node, missing []string, err error) {
+	defer g.returnError(&err)
+	raw, err := g.repo.FetchNodesByName(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	byName := make(map[string]*Node, len(raw))
+	for i := range raw {
+		n := nodeFromData(&raw[i])
+		byName[n.Name] = n
+	}
+	for _, name := range names {
+		if n, ok := byName[name]; ok {
+			found = append(found, n)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	return found, missing, nil
+}
+
+func nodeFromData(n *data.Node) *Node {
+	return &Node{
+		Gid:        Nid(n.Gid),
+		Name:       n.Name,
+		Attributes: Attributes(n.Attributes),
+		Labels:     n.Labels,
+	}
+}
+
+func (g *G) Walk(from NodeRef, using string) (RelationSet, error) {
+	return g.WalkWith(from, using, WalkOptions{})
+}
+
+// WalkWith works like Walk but only returns the relations allowed by opts
+func (g *G) WalkWith(from NodeRef, using string, opts WalkOptions) (_ RelationSet, err error) {
+	span, end := g.startSpan("ograph.Walk")
+	defer func() { end(err) }()
+	defer g.returnError(&err)
+	traceWalk(span, from, using)
+	raw, err := g.repo.WalkWith(uint64(from.Identity().Gid), using, opts.data(), nil)
 	if err != nil {
 		return nil, err
 	}
+	span.SetAttribute("ograph.rows", len(raw))
+	return relationSet(raw), nil
+}
+
+// WalkEach calls fn for every relation as it is read, without loading all of them
+// first. All relations share the same From node. An error from fn stops the walk.
+func (g *G) WalkEach(from NodeRef, using string, opts WalkOptions, fn func(*Relation) error) (err error) {
+	span, end := g.startSpan("ograph.WalkEach")
+	rows := 0
+	defer func() {
+		span.SetAttribute("ograph.rows", rows)
+		end(err)
+	}()
+	defer g.returnError(&err)
+	traceWalk(span, from, using)
+	var fromN *Node
+	return g.repo.WalkEach(uint64(from.Identity().Gid), using, opts.data(), func(r *data.Relation) error {
+		if fromN == nil {
+			fromN = &Node{
+				Gid:        Nid(r.FromGid),
+				Name:       r.FromName,
+				Attributes: Attributes(r.FromAttributes),
+				Labels:     r.FromLabels,
+			}
+		}
+		rows++
+		return fn(&Relation{
+			From: fromN,
+			To: &Node{
+				Gid:        Nid(r.ToGid),
+				Name:       r.ToName,
+				Attributes: Attributes(r.ToAttributes),
+				Labels:     r.ToLabels,
+			},
+			Attributes: Attributes(r.Attributes),
+			Name:       r.Name,
+			Rid:        Rid(r.Rid),
+		})
+	})
+}
+
+func (o WalkOptions) data() *data.WalkOptions {
+	out := &data.WalkOptions{
+		ToLabels: o.ToLabels,
+		Limit:    o.Limit,
+		After:    uint64(o.After),
+		Offset:   o.Offset,
+	}
+	for _, order := range o.OrderBy {
+		out.OrderBy = append(out.OrderBy, data.Order{
+			By:   order.by,
+			Path: order.path,
+			Desc: order.Descending,
+		})
+	}
+	return out
+}
+
+// ByTargetName sorts the relations by the name of the node they point to
+func ByTargetName() Order {
+	return Order{by: data.OrderByToName}
+}
+
+// ByTargetAttribute sorts the relations by an attribute of the node they point to,
+// path is the list of keys to reach the attribute
+func ByTargetAttribute(path ...string) Order {
+	return Order{by: data.OrderByToAttribute, path: path}
+}
+
+// ByRelationAttribute sorts the relations by one of their attributes
+func ByRelationAttribute(path ...string) Order {
+	return Order{by: data.OrderByAttribute, path: path}
+}
+
+// Desc returns the same order, but descending
+func (o Order) Desc() Order {
+	o.Descending = true
+	return o
+}
+
+// Cursor returns the value of WalkOptions.After to read the page after this one
+func (rs RelationSet) Cursor() Rid {
+	if len(rs) == 0 {
+		return InvalidRid
+	}
+	return rs[len(rs)-1].Rid
+}
+
+// relationSet converts the relations from the data package, the endpoints
+// that appear more than once share the same *Node
+func relationSet(raw data.RelationSet) RelationSet {
 	nodes := make(map[uint64]*Node)
 	out := make(RelationSet, len(raw))
 
@@ -203,6 +794,7 @@ func (g *G) Walk(from *Node, using string) (RelationSet, error) {
 				Gid: Nid(r.FromGid),
 				Name: r.FromName,
 				Attributes: Attributes(r.FromAttributes),
+				Labels: r.FromLabels,
 			}
 			nodes[r.FromGid] = fromN
 		}
@@ -213,6 +805,7 @@ func (g *G) Walk(from *Node, using string) (RelationSet, error) {
 				Gid: Nid(r.ToGid),
 				Name: r.ToName,
 				Attributes: Attributes(r.ToAttributes),
+				Labels: r.ToLabels,
 			}
 			nodes[r.ToGid] = toN
 		}
@@ -221,12 +814,208 @@ func (g *G) Walk(from *Node, using string) (RelationSet, error) {
 			To: toN,
 			Attributes: Attributes(r.Attributes),
 			Name: r.Name,
+			Rid: Rid(r.Rid),
 		}
 		out[i] = rel
 	}
+	return out
+}
+
+// OutDegree counts the relations from the node, an empty name counts
+// the relations with any name
+func (g *G) OutDegree(n NodeRef, name string) (_ int64, err error) {
+	defer g.returnError(&err)
+	return g.repo.Degree(uint64(n.Identity().Gid), name, data.Outgoing)
+}
+
+// InDegree counts the relations to the node, an empty name counts
+// the relations with any name
+func (g *G) InDegree(n NodeRef, name string) (_ int64, err error) {
+	defer g.returnError(&err)
+	return g.repo.Degree(uint64(n.Identity().Gid), name, data.Incoming)
+}
+
+// Summary counts the nodes, the relations by name and returns the top
+// nodes with more relations
+func (g *G) Summary(top int) (_ *Summary, err error) {
+	defer g.returnError(&err)
+	raw, err := g.repo.Summary(top)
+	if err != nil {
+		return nil, err
+	}
+	out := &Summary{Nodes: raw.Nodes}
+	for _, u := range raw.Relations {
+		out.Relations = append(out.Relations, RelationName{Name: u.Name, Count: u.Count})
+	}
+	for i := range raw.TopNodes {
+		nd := &raw.TopNodes[i]
+		out.TopNodes = append(out.TopNodes, NodeDegree{
+			Node: nodeFromData(&nd.Node),
+			Out:  nd.Outgoing,
+			In:   nd.Incoming,
+		})
+	}
 	return out, nil
 }
 
-func (g *G) Close() error {
+// HasRelation checks if there is a relation with the given name between the nodes
+func (g *G) HasRelation(from NodeRef, name string, to NodeRef) (_ bool, err error) {
+	defer g.returnError(&err)
+	return g.repo.HasRelation(uint64(from.Identity().Gid), uint64(to.Identity().Gid), name)
+}
+
+// HasRelations works like HasRelation for many relations using a single query,
+// the result has the same order as checks
+func (g *G) HasRelations(checks []RelationCheck) (_ []bool, err error) {
+	defer g.returnError(&err)
+	keys := make([]data.RelationKey, len(checks))
+	for i, c := range checks {
+		keys[i] = data.RelationKey{
+			FromGid: uint64(c.From.Identity().Gid),
+			ToGid:   uint64(c.To.Identity().Gid),
+			Name:    c.Name,
+		}
+	}
+	return g.repo.HasRelations(keys)
+}
+
+func (g *G) Close() (err error) {
+	defer g.returnError(&err)
 	return g.repo.Close()
 }
+
+// RelationNames lists all relation names known by the graph, including the ones
+// without any relation
+func (g *G) RelationNames() (_ []RelationName, err error) {
+	defer g.returnError(&err)
+	usage, err := g.repo.KeywordUsage()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]RelationName, len(usage))
+	for i, u := range usage {
+		out[i] = RelationName{
+			Name:  u.Name,
+			Count: u.Count,
+		}
+	}
+	return out, nil
+}
+
+// RenameRelation changes the name of every relation called from,
+// the schema set by SetRelationSchema follows them
+func (g *G) RenameRelation(from, to string) (err error) {
+	defer g.returnError(&err)
+	g.repo.Begin()
+	g.repo.RenameKeyword(from, to)
+	if err = g.repo.End(); err == nil {
+		g.moveRelationSchema(from, to)
+	}
+	return err
+}
+
+// DeleteRelationName removes a relation name and its schema, only names
+// without relations can be removed
+func (g *G) DeleteRelationName(name string) (err error) {
+	defer g.returnError(&err)
+	g.repo.Begin()
+	g.repo.DeleteKeyword(name)
+	if err = g.repo.End(); err == nil {
+		g.moveRelationSchema(name, "")
+	}
+	return err
+}
+
+// SetRelationRule creates or replaces the rule of the relations named rule.Name.
+// SaveAll fails with a *RuleError when a relation breaks its rule.
+func (g *G) SetRelationRule(rule RelationRule) (err error) {
+	defer g.returnError(&err)
+	g.repo.Begin()
+	defer g.repo.End()
+	return g.repo.SaveRelationRule(&data.RelationRule{
+		Name:        rule.Name,
+		Cardinality: data.Cardinality(rule.Cardinality),
+		NoSelfLoops: rule.NoSelfLoops,
+		Multi:       rule.Multi,
+		FromPattern: rule.FromPattern,
+		ToPattern:   rule.ToPattern,
+	})
+}
+
+// RelationRule returns the rule of the relations with the given name
+func (g *G) RelationRule(name string) (_ *RelationRule, err error) {
+	defer g.returnError(&err)
+	var rule data.RelationRule
+	if err := g.repo.RelationRule(name, &rule); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &RelationRule{
+		Name:        rule.Name,
+		Cardinality: Cardinality(rule.Cardinality),
+		NoSelfLoops: rule.NoSelfLoops,
+		Multi:       rule.Multi,
+		FromPattern: rule.FromPattern,
+		ToPattern:   rule.ToPattern,
+	}, nil
+}
+
+// DeleteRelationRule removes the rule of the relations with the given name
+func (g *G) DeleteRelationRule(name string) (err error) {
+	defer g.returnError(&err)
+	g.repo.Begin()
+	defer g.repo.End()
+	return g.repo.DeleteRelationRule(name)
+}
+
+// translateError converts the errors from the data package into the
+// errors of this package
+func translateError(err error) error {
+	if re, ok := err.(*data.RuleError); ok {
+		return &RuleError{Name: re.Name, From: Nid(re.FromGid), To: Nid(re.ToGid), Reason: re.Reason}
+	}
+	switch err {
+	case sql.ErrNoRows, data.ErrKeywordNotFound:
+		err = ErrNotFound
+	case data.ErrKeywordExists:
+		err = ErrRelationNameExists
+	case data.ErrKeywordInUse:
+		err = ErrRelationNameInUse
+	case data.ErrInvalidStep:
+		err = ErrInvalidStep
+	}
+	return err
+}
+
+// errorKind is the kind used to count err, empty for the errors that
+// aren't counted
+func errorKind(err error) string {
+	switch err := err.(type) {
+	case ApiError:
+		return err.Kind()
+	case *ValidationError:
+		return "validation"
+	case *RuleError:
+		return "rule"
+	}
+	return ""
+}
+
+// apiError translates err and counts it in the metrics of the Repo
+func (g *G) apiError(err error) error {
+	err = translateError(err)
+	// g is nil for the empty Query given to Repeat and Until
+	if kind := errorKind(err); len(kind) > 0 && g != nil {
+		g.repo.Metrics.CountError(kind)
+	}
+	return err
+}
+
+// returnError replaces the error returned by an exported method with
+// its apiError, use it with defer and a named result
+func (g *G) returnError(err *error) {
+	if *err != nil {
+		*err = g.apiError(*err)
+	}
+}
@@ -20,10 +20,15 @@
 package ograph
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http/httptest"
 	"testing"
 	"github.com/andrebq/ograph/data"
+	"github.com/andrebq/ograph/trace"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -69,6 +74,49 @@ func TestSave(t *testing.T) {
 	}
 }
 
+func TestUpsert(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+	neo := &Node{
+		Name:       "neo",
+		Attributes: `{"ship": "nebuchadnezzar"}`,
+	}
+	if err := g.SaveAll(neo); err != nil {
+		t.Fatalf("error saving node: %v", err)
+	}
+
+	again := &Node{
+		Name:       "neo",
+		Attributes: `{"alias": "the one"}`,
+	}
+	if err := g.SaveAll(again.Upsert(MergeAttributes)); err != nil {
+		t.Fatalf("error upserting node: %v", err)
+	}
+	if again.Gid != neo.Gid {
+		t.Fatalf("upsert should reuse the existing node. expecting %v got %v", neo.Gid, again.Gid)
+	}
+
+	var attrs map[string]string
+	if err := json.Unmarshal([]byte(again.Attributes), &attrs); err != nil {
+		t.Fatalf("error decoding attributes %v: %v", again.Attributes, err)
+	}
+	expected := map[string]string{"ship": "nebuchadnezzar", "alias": "the one"}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("attributes should be merged. expecting %v got %v", expected, attrs)
+	}
+
+	kept := &Node{
+		Name:       "neo",
+		Attributes: `{"ship": "logos"}`,
+	}
+	if err := g.SaveAll(kept.Upsert(KeepAttributes)); err != nil {
+		t.Fatalf("error upserting node: %v", err)
+	}
+	if kept.Attributes != again.Attributes {
+		t.Fatalf("upsert should keep the attributes. expecting %v got %v", again.Attributes, kept.Attributes)
+	}
+}
+
 func TestSaveRelation(t *testing.T) {
 	g := mustOpenGraph(t)
 	defer g.Close()
@@ -118,8 +166,18 @@ func TestWalk(t *testing.T) {
 }
 
 func BenchmarkSingleNodeInsert(b *testing.B) {
+	benchmarkSingleNodeInsert(b, mustOpenGraph(b))
+}
+
+// BenchmarkSingleNodeInsertUnprepared is BenchmarkSingleNodeInsert without
+// reusing prepared statements, to compare with it
+func BenchmarkSingleNodeInsertUnprepared(b *testing.B) {
 	g := mustOpenGraph(b)
+	g.repo.Unprepared = true
+	benchmarkSingleNodeInsert(b, g)
+}
 
+func benchmarkSingleNodeInsert(b *testing.B, g *G) {
 	b.ResetTimer()
 	prefix := fmt.Sprintf("%v", time.Now().UnixNano())
 	for i := 0; i < b.N; i++ {
@@ -133,8 +191,16 @@ func BenchmarkSingleNodeInsert(b *testing.B) {
 }
 
 func BenchmarkRelationInsert(b *testing.B) {
+	benchmarkRelationInsert(b, mustOpenGraph(b))
+}
+
+func BenchmarkRelationInsertUnprepared(b *testing.B) {
 	g := mustOpenGraph(b)
+	g.repo.Unprepared = true
+	benchmarkRelationInsert(b, g)
+}
 
+func benchmarkRelationInsert(b *testing.B, g *G) {
 	prefix := fmt.Sprintf("%v", time.Now().UnixNano())
 	nodeA := &Node{
 		Name: "nodeA-" + prefix,
@@ -154,3 +220,1088 @@ func BenchmarkRelationInsert(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkWalk(b *testing.B) {
+	benchmarkWalk(b, mustOpenGraph(b))
+}
+
+func BenchmarkWalkUnprepared(b *testing.B) {
+	g := mustOpenGraph(b)
+	g.repo.Unprepared = true
+	benchmarkWalk(b, g)
+}
+
+func benchmarkWalk(b *testing.B, g *G) {
+	from := &Node{Name: "from"}
+	what := []interface{}{from}
+	for i := 0; i < 10; i++ {
+		to := &Node{Name: fmt.Sprintf("to-%v", i)}
+		what = append(what, to, from.Rel("knows", to))
+	}
+	if err := g.SaveAll(what...); err != nil {
+		b.Fatalf("error saving all: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.Walk(from, "knows"); err != nil {
+			b.Fatalf("error walking: %v", err)
+		}
+	}
+}
+
+func TestRelationNames(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	if err := g.SaveAll(neo, morpheus, neo.Rel("knows", morpheus)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	if err := g.DeleteRelationName("knows"); err != ErrRelationNameInUse {
+		t.Fatalf("should not delete a name in use. got %v", err)
+	}
+	if err := g.RenameRelation("knows", "trusts"); err != nil {
+		t.Fatalf("error renaming relation: %v", err)
+	}
+	if relations, err := g.Walk(neo, "trusts"); err != nil || len(relations) != 1 {
+		t.Fatalf("relation should be renamed. got %v / %v", relations, err)
+	}
+
+	names, err := g.RelationNames()
+	if err != nil {
+		t.Fatalf("error listing relation names: %v", err)
+	}
+	expected := []RelationName{{Name: "trusts", Count: 1}}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("invalid relation names. expecting %v got %v", expected, names)
+	}
+}
+
+func TestRelationRule(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	rule := RelationRule{
+		Name:        "works_at",
+		Cardinality: ManyToOne,
+		NoSelfLoops: true,
+		ToPattern:   "company:%",
+	}
+	if err := g.SetRelationRule(rule); err != nil {
+		t.Fatalf("error saving rule: %v", err)
+	}
+	if saved, err := g.RelationRule("works_at"); err != nil {
+		t.Fatalf("error reading rule: %v", err)
+	} else if !reflect.DeepEqual(*saved, rule) {
+		t.Fatalf("invalid rule. expecting %v got %v", rule, *saved)
+	}
+
+	neo := &Node{Name: "person:neo"}
+	metacortex := &Node{Name: "company:metacortex"}
+	if err := g.SaveAll(neo, metacortex, neo.Rel("works_at", metacortex)); err != nil {
+		t.Fatalf("error saving valid relation: %v", err)
+	}
+
+	invalid := []struct {
+		from, to string
+		existing *Node
+	}{
+		{from: "person:trinity", to: "team:zion"},
+		{from: "company:cyberdyne", to: "company:cyberdyne"},
+		{from: "person:smith", to: "company:sati", existing: metacortex},
+	}
+	for _, c := range invalid {
+		from, to := &Node{Name: c.from}, &Node{Name: c.to}
+		if c.from == c.to {
+			to = from
+		}
+		if err := g.SaveAll(from, to); err != nil {
+			t.Fatalf("error saving nodes: %v", err)
+		}
+		if c.existing != nil {
+			if err := g.SaveAll(from.Rel("works_at", c.existing)); err != nil {
+				t.Fatalf("error saving existing relation: %v", err)
+			}
+		}
+		err := g.SaveAll(from.Rel("works_at", to))
+		if _, ok := err.(*RuleError); !ok {
+			t.Errorf("%v -> %v should break the rule. got %v", c.from, c.to, err)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo", Labels: []string{"person", "hacker", "person"}}
+	morpheus := &Node{Name: "morpheus", Labels: []string{"person"}}
+	nebuchadnezzar := &Node{Name: "nebuchadnezzar", Labels: []string{"ship"}}
+	if err := g.SaveAll(neo, morpheus, nebuchadnezzar,
+		neo.Rel("knows", morpheus), neo.Rel("knows", nebuchadnezzar)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	if expected := []string{"hacker", "person"}; !reflect.DeepEqual(neo.Labels, expected) {
+		t.Fatalf("labels should be sorted and unique. expecting %v got %v", expected, neo.Labels)
+	}
+
+	if persons, err := g.NodesWithLabel("person"); err != nil {
+		t.Fatalf("error searching by label: %v", err)
+	} else if !reflect.DeepEqual(persons, []*Node{neo, morpheus}) {
+		t.Fatalf("invalid nodes with label person. got %v", persons)
+	}
+
+	relations, err := g.WalkWith(neo, "knows", WalkOptions{ToLabels: []string{"person"}})
+	if err != nil {
+		t.Fatalf("error walking with labels: %v", err)
+	}
+	if len(relations) != 1 || !relations[0].To.Is(morpheus) {
+		t.Fatalf("should only walk to morpheus. got %v", relations)
+	}
+
+	// nil keeps the stored labels, an empty slice removes them
+	withoutLabels := &Node{Gid: neo.Gid, Name: neo.Name, Attributes: `{"saved": true}`}
+	if err := g.SaveAll(withoutLabels); err != nil {
+		t.Fatalf("error saving node: %v", err)
+	}
+	if !reflect.DeepEqual(withoutLabels.Labels, neo.Labels) {
+		t.Fatalf("labels should be kept. expecting %v got %v", neo.Labels, withoutLabels.Labels)
+	}
+	withoutLabels.Labels = []string{}
+	if err := g.SaveAll(withoutLabels); err != nil {
+		t.Fatalf("error saving node: %v", err)
+	}
+	if hackers, err := g.NodesWithLabel("hacker"); err != nil || len(hackers) != 0 {
+		t.Fatalf("labels should be removed. got %v / %v", hackers, err)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	if err := g.SetNodeSchema("person", `{"type": "object", "required": ["age"],
+		"properties": {"age": {"type": "integer", "minimum": 0}}}`); err != nil {
+		t.Fatalf("error registering node schema: %v", err)
+	}
+	if err := g.SetRelationSchema("knows", `{"properties": {"since": {"type": "integer"}}}`); err != nil {
+		t.Fatalf("error registering relation schema: %v", err)
+	}
+
+	neo := &Node{Name: "neo", Labels: []string{"person"}, Attributes: `{"age": 30}`}
+	morpheus := &Node{Name: "morpheus", Labels: []string{"person"}, Attributes: `{"age": -1}`}
+	rel := neo.Rel("knows", morpheus)
+	rel.Attributes = `{"since": "1999"}`
+
+	err := g.SaveAll(neo, morpheus, rel)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expecting a validation error got %v", err)
+	}
+	expected := []Violation{
+		{Subject: "morpheus", Schema: "person", Path: "$.age", Message: "must be >= 0"},
+		{Subject: "knows", Schema: "knows", Path: "$.since", Message: "expecting integer got string"},
+	}
+	if !reflect.DeepEqual(verr.Violations, expected) {
+		t.Fatalf("invalid violations. expecting %v got %v", expected, verr.Violations)
+	}
+	if neo.Gid != InvalidNid {
+		t.Fatalf("nothing should be saved when validation fails")
+	}
+
+	morpheus.Attributes = `{"age": 38}`
+	rel.Attributes = `{"since": 1999}`
+	if err := g.SaveAll(neo, morpheus, rel); err != nil {
+		t.Fatalf("error saving valid nodes: %v", err)
+	}
+
+	// the schemas are stored, another G using the same database loads them
+	other := &G{}
+	other.Use(&data.Repo{Db: g.repo.Db, Keywords: g.repo.Keywords})
+	trinity := &Node{Name: "trinity", Labels: []string{"person"}}
+	if _, ok := other.SaveAll(trinity).(*ValidationError); !ok {
+		t.Fatalf("the stored schema should be used by another graph")
+	}
+	if err := g.SetNodeSchema("person", ""); err != nil {
+		t.Fatalf("error removing node schema: %v", err)
+	}
+	if err := other.ReloadSchemas(); err != nil {
+		t.Fatalf("error reloading schemas: %v", err)
+	}
+	if err := other.SaveAll(trinity); err != nil {
+		t.Fatalf("the removed schema should not be used. got %v", err)
+	}
+
+	// a node saved without labels keeps its stored ones, and their schemas
+	if err := g.SetNodeSchema("pilot", `{"required": ["ship"]}`); err != nil {
+		t.Fatalf("error registering node schema: %v", err)
+	}
+	sparks := &Node{Name: "sparks", Labels: []string{"pilot"}, Attributes: `{"ship": "nebuchadnezzar"}`}
+	if err := g.SaveAll(sparks); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	if _, ok := g.SaveAll(&Node{Gid: sparks.Gid, Name: "sparks", Attributes: `{}`}).(*ValidationError); !ok {
+		t.Fatalf("the schema of the stored labels should be used")
+	}
+
+	// the schema follows the renamed relations
+	if err := g.RenameRelation("knows", "trusts"); err != nil {
+		t.Fatalf("error renaming relation: %v", err)
+	}
+	if err := other.ReloadSchemas(); err != nil {
+		t.Fatalf("error reloading schemas: %v", err)
+	}
+	for _, graph := range []*G{g, other} {
+		trusts := neo.Rel("trusts", morpheus)
+		trusts.Attributes = `{"since": "1999"}`
+		if _, ok := graph.SaveAll(trusts).(*ValidationError); !ok {
+			t.Fatalf("the schema should follow the renamed relations")
+		}
+		knows := neo.Rel("knows", morpheus)
+		knows.Attributes = `{"since": "1999"}`
+		if err := graph.SaveAll(knows); err != nil {
+			t.Fatalf("the old name should not have a schema. got %v", err)
+		}
+		if err := graph.DeleteAll(knows); err != nil {
+			t.Fatalf("error deleting all: %v", err)
+		}
+	}
+}
+
+func TestMultiRelations(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	if err := g.SetRelationRule(RelationRule{Name: "transferred_to", Multi: true}); err != nil {
+		t.Fatalf("error saving rule: %v", err)
+	}
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	first := neo.Rel("transferred_to", morpheus)
+	first.Attributes = `{"amount": 10}`
+	second := neo.Rel("transferred_to", morpheus)
+	second.Attributes = `{"amount": 20}`
+	if err := g.SaveAll(neo, morpheus, first, second); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	if relations, err := g.Walk(neo, "transferred_to"); err != nil {
+		t.Fatalf("error walking: %v", err)
+	} else if len(relations) != 2 {
+		t.Fatalf("expecting two relations but got %v", len(relations))
+	}
+
+	// relations without the Multi rule are still unique
+	if err := g.SaveAll(neo.Rel("knows", morpheus), neo.Rel("knows", morpheus)); err != nil {
+		t.Fatalf("error saving relation: %v", err)
+	}
+	if relations, err := g.Walk(neo, "knows"); err != nil {
+		t.Fatalf("error walking: %v", err)
+	} else if len(relations) != 1 {
+		t.Fatalf("expecting one relation but got %v", len(relations))
+	}
+}
+
+func TestRelationById(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	rel := neo.Rel("knows", morpheus)
+	rel.Attributes = `{"since": 1999}`
+	if err := g.SaveAll(neo, morpheus, rel); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	if rel.Rid == InvalidRid {
+		t.Fatalf("SaveAll should set the relation id")
+	}
+
+	if fetch, err := g.Relation(rel.Rid, nil); err != nil {
+		t.Fatalf("error loading relation: %v", err)
+	} else if !reflect.DeepEqual(fetch, rel) {
+		t.Fatalf("invalid relation. expecting %v got %v", rel, fetch)
+	}
+
+	if err := g.DeleteAll(rel.Rid); err != nil {
+		t.Fatalf("error deleting relation: %v", err)
+	}
+	if _, err := g.Relation(rel.Rid, nil); err != ErrNotFound {
+		t.Fatalf("deleted relation should not be found. got %v", err)
+	}
+
+	// a *Relation with Rid doesn't need its nodes
+	again := neo.Rel("knows", morpheus)
+	if err := g.SaveAll(again); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	if err := g.DeleteAll(&Relation{Rid: again.Rid}); err != nil {
+		t.Fatalf("error deleting relation: %v", err)
+	}
+	if _, err := g.Relation(again.Rid, nil); err != ErrNotFound {
+		t.Fatalf("deleted relation should not be found. got %v", err)
+	}
+	if err := g.DeleteAll(&Relation{Name: "knows"}); err == nil {
+		t.Fatalf("a relation without Rid and nodes should not be deleted")
+	}
+}
+
+func TestNodeRef(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	if err := g.SaveAll(neo, morpheus); err != nil {
+		t.Fatalf("error saving nodes: %v", err)
+	}
+
+	// only the ids are needed to link and walk
+	from, to := Identity{Gid: neo.Gid}, morpheus.Gid
+	if err := g.SaveAll(Rel(from, "knows", to)); err != nil {
+		t.Fatalf("error saving relation: %v", err)
+	}
+	if relations, err := g.Walk(from, "knows"); err != nil {
+		t.Fatalf("error walking: %v", err)
+	} else if len(relations) != 1 || !relations[0].To.Is(morpheus) {
+		t.Fatalf("should walk to morpheus. got %v", relations)
+	}
+
+	if out, err := g.Node(from, "", nil); err != nil || !reflect.DeepEqual(out, neo) {
+		t.Fatalf("should load neo by identity. got %v / %v", out, err)
+	}
+
+	if err := g.DeleteAll(to); err != nil {
+		t.Fatalf("error deleting morpheus: %v", err)
+	}
+	if relations, err := g.Walk(from, "knows"); err != nil || len(relations) != 0 {
+		t.Fatalf("relations to morpheus should be removed. got %v / %v", relations, err)
+	}
+}
+
+func TestRelationByName(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	morpheus := &Node{Name: "morpheus", Attributes: `{"ship": "nebuchadnezzar"}`}
+	if err := g.SaveAll(morpheus); err != nil {
+		t.Fatalf("error saving morpheus: %v", err)
+	}
+
+	// neo is saved after the relation in the list, trinity doesn't exist
+	// and morpheus is only known by name
+	neo := &Node{Name: "neo"}
+	knowsMorpheus := neo.Rel("knows", &Node{Name: "morpheus"})
+	knowsTrinity := neo.Rel("knows", &Node{Name: "trinity"})
+	if err := g.SaveAll(knowsMorpheus, knowsTrinity, neo); err != nil {
+		t.Fatalf("error saving relations by name: %v", err)
+	}
+	if knowsMorpheus.To.Gid != morpheus.Gid {
+		t.Fatalf("should resolve morpheus by name. expecting %v got %v", morpheus.Gid, knowsMorpheus.To.Gid)
+	}
+	if knowsMorpheus.To.Attributes != morpheus.Attributes {
+		t.Fatalf("existing attributes should be kept. expecting %v got %v", morpheus.Attributes, knowsMorpheus.To.Attributes)
+	}
+	if knowsTrinity.To.Gid == InvalidNid {
+		t.Fatalf("trinity should be created")
+	}
+
+	if relations, err := g.Walk(neo, "knows"); err != nil || len(relations) != 2 {
+		t.Fatalf("expecting two relations from neo. got %v / %v", relations, err)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	if err := g.SaveAll(neo, morpheus); err != nil {
+		t.Fatalf("error saving nodes: %v", err)
+	}
+
+	unknown := morpheus.Gid + 1000
+	found, missing, err := g.Nodes([]Nid{morpheus.Gid, unknown, neo.Gid})
+	if err != nil {
+		t.Fatalf("error loading nodes: %v", err)
+	}
+	if !reflect.DeepEqual(found, []*Node{morpheus, neo}) {
+		t.Fatalf("invalid nodes. got %v", found)
+	}
+	if !reflect.DeepEqual(missing, []Nid{unknown}) {
+		t.Fatalf("invalid missing ids. got %v", missing)
+	}
+
+	foundByName, missingNames, err := g.NodesByName([]string{"neo", "trinity"})
+	if err != nil {
+		t.Fatalf("error loading nodes by name: %v", err)
+	}
+	if !reflect.DeepEqual(foundByName, []*Node{neo}) || !reflect.DeepEqual(missingNames, []string{"trinity"}) {
+		t.Fatalf("invalid result. got %v and missing %v", foundByName, missingNames)
+	}
+}
+
+func TestWalkPages(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	what := []interface{}{neo}
+	for i := 0; i < 5; i++ {
+		what = append(what, neo.Rel("knows", &Node{Name: fmt.Sprintf("agent-%v", i)}))
+	}
+	if err := g.SaveAll(what...); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	var pages []int
+	opts := WalkOptions{Limit: 2}
+	for {
+		page, err := g.WalkWith(neo, "knows", opts)
+		if err != nil {
+			t.Fatalf("error reading page: %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, len(page))
+		opts.After = page.Cursor()
+	}
+	if !reflect.DeepEqual(pages, []int{2, 2, 1}) {
+		t.Fatalf("invalid pages. got %v", pages)
+	}
+
+	count := 0
+	stop := errors.New("stop")
+	err := g.WalkEach(neo, "knows", WalkOptions{}, func(r *Relation) error {
+		if !r.From.Is(neo) {
+			t.Errorf("relation should be from neo. got %v", r.From)
+		}
+		count++
+		if count == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || count != 3 {
+		t.Fatalf("WalkEach should stop when fn fails. got %v after %v relations", err, count)
+	}
+}
+
+func TestWalkOrder(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	what := []interface{}{neo}
+	for i, name := range []string{"trinity", "morpheus", "tank", "switch"} {
+		rel := neo.Rel("knows", &Node{Name: name, Attributes: Attributes(fmt.Sprintf(`{"rank": %v}`, i))})
+		rel.Attributes = Attributes(fmt.Sprintf(`{"since": %v}`, 1999-i))
+		what = append(what, rel)
+	}
+	if err := g.SaveAll(what...); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	names := func(opts WalkOptions) []string {
+		relations, err := g.WalkWith(neo, "knows", opts)
+		if err != nil {
+			t.Fatalf("error walking with %v: %v", opts, err)
+		}
+		var out []string
+		for _, r := range relations {
+			out = append(out, r.To.Name)
+		}
+		return out
+	}
+
+	if got := names(WalkOptions{OrderBy: []Order{ByTargetName()}}); !reflect.DeepEqual(got, []string{"morpheus", "switch", "tank", "trinity"}) {
+		t.Errorf("invalid order by name. got %v", got)
+	}
+	if got := names(WalkOptions{OrderBy: []Order{ByTargetAttribute("rank").Desc()}, Limit: 2}); !reflect.DeepEqual(got, []string{"switch", "tank"}) {
+		t.Errorf("invalid order by target attribute. got %v", got)
+	}
+	if got := names(WalkOptions{OrderBy: []Order{ByRelationAttribute("since").Desc()}, Limit: 2, Offset: 1}); !reflect.DeepEqual(got, []string{"morpheus", "tank"}) {
+		t.Errorf("invalid order by relation attribute. got %v", got)
+	}
+}
+
+func TestDegree(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	trinity := &Node{Name: "trinity"}
+	if err := g.SaveAll(neo, morpheus, trinity,
+		neo.Rel("knows", morpheus), neo.Rel("knows", trinity),
+		trinity.Rel("loves", neo), morpheus.Rel("follows", neo)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	for _, c := range []struct {
+		count    func(NodeRef, string) (int64, error)
+		name     string
+		expected int64
+	}{
+		{g.OutDegree, "knows", 2},
+		{g.OutDegree, "", 2},
+		{g.InDegree, "", 2},
+		{g.InDegree, "loves", 1},
+		{g.InDegree, "unknown", 0},
+	} {
+		if n, err := c.count(neo, c.name); err != nil || n != c.expected {
+			t.Errorf("invalid degree for %q. expecting %v got %v / %v", c.name, c.expected, n, err)
+		}
+	}
+
+	summary, err := g.Summary(1)
+	if err != nil {
+		t.Fatalf("error reading summary: %v", err)
+	}
+	expected := &Summary{
+		Nodes: 3,
+		Relations: []RelationName{
+			{Name: "follows", Count: 1},
+			{Name: "knows", Count: 2},
+			{Name: "loves", Count: 1},
+		},
+		TopNodes: []NodeDegree{{Node: neo, Out: 2, In: 2}},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("invalid summary. expecting %v got %v", expected, summary)
+	}
+}
+
+func TestHasRelation(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	if err := g.SaveAll(neo, morpheus, neo.Rel("knows", morpheus)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	if ok, err := g.HasRelation(neo, "knows", morpheus); err != nil || !ok {
+		t.Fatalf("neo should know morpheus. got %v / %v", ok, err)
+	}
+
+	found, err := g.HasRelations([]RelationCheck{
+		{From: neo, Name: "knows", To: morpheus},
+		{From: morpheus, Name: "knows", To: neo},
+		{From: neo, Name: "unknown", To: morpheus},
+		{From: neo.Gid, Name: "knows", To: Identity{Gid: morpheus.Gid}},
+	})
+	if err != nil {
+		t.Fatalf("error checking relations: %v", err)
+	}
+	if expected := []bool{true, false, false, true}; !reflect.DeepEqual(found, expected) {
+		t.Fatalf("invalid result. expecting %v got %v", expected, found)
+	}
+}
+
+func TestRelationBetween(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	rel := neo.Rel("knows", morpheus)
+	rel.Attributes = `{"since": 1999}`
+	if err := g.SaveAll(neo, morpheus, rel); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	if fetch, err := g.RelationBetween(neo, "knows", morpheus); err != nil {
+		t.Fatalf("error loading relation: %v", err)
+	} else if !reflect.DeepEqual(fetch, rel) {
+		t.Fatalf("invalid relation. expecting %v got %v", rel, fetch)
+	}
+
+	for _, name := range []string{"knows", "unknown"} {
+		if _, err := g.RelationBetween(morpheus, name, neo); err != ErrNotFound {
+			t.Errorf("%v from morpheus should not be found. got %v", name, err)
+		}
+	}
+
+	// a missing relation doesn't break the graph
+	if err := g.SaveAll(morpheus.Rel("knows", neo)); err != nil {
+		t.Fatalf("error saving after a missing relation: %v", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo", Labels: []string{"person"}, Attributes: `{"age": 30}`}
+	morpheus := &Node{Name: "morpheus", Labels: []string{"person"}, Attributes: `{"age": 40}`}
+	trinity := &Node{Name: "trinity", Labels: []string{"person"}, Attributes: `{"age": 29}`}
+	ship := &Node{Name: "nebuchadnezzar"}
+	if err := g.SaveAll(neo, morpheus, trinity, ship,
+		neo.Rel("knows", morpheus), neo.Rel("knows", trinity), neo.Rel("knows", ship),
+		trinity.Rel("knows", morpheus)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	res, err := g.Exec(`MATCH (a {name: $who})-[:knows]->(b:person)
+		WHERE b.age > 29
+		RETURN b.name, b.age ORDER BY b.name`, map[string]interface{}{"who": "neo"})
+	if err != nil {
+		t.Fatalf("error running query: %v", err)
+	}
+	expected := &Result{
+		Columns: []string{"b.name", "b.age"},
+		Rows:    [][]interface{}{{"morpheus", float64(40)}},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("invalid result. expecting %v got %v", expected, res)
+	}
+
+	// friends of neo that also know each other
+	res, err = g.Exec(`MATCH (a)-[r:knows]->(b), (a)-[:knows]->(c)
+		WHERE (b)-[:knows]->(c)
+		RETURN a, r, count(*) AS total`, nil)
+	if err != nil {
+		t.Fatalf("error running query: %v", err)
+	}
+	if len(res.Rows) != 1 {
+		t.Fatalf("expecting one row got %v", res.Rows)
+	}
+	if a := res.Rows[0][0].(*Node); a.Gid != neo.Gid || !reflect.DeepEqual(a.Labels, neo.Labels) {
+		t.Errorf("expecting %v got %v", neo, a)
+	}
+	if r := res.Rows[0][1].(*Relation); r.Name != "knows" || r.To.Gid != trinity.Gid {
+		t.Errorf("expecting neo knows trinity got %v", r)
+	}
+	if total := res.Rows[0][2]; total != int64(1) {
+		t.Errorf("expecting 1 got %v", total)
+	}
+
+	if _, err := g.Exec(`MATCH (a) RETURN`, nil); err == nil {
+		t.Errorf("invalid query should fail")
+	}
+}
+
+func TestQuerySteps(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo", Labels: []string{"person"}}
+	morpheus := &Node{Name: "morpheus", Labels: []string{"person"}}
+	trinity := &Node{Name: "trinity", Labels: []string{"person"}}
+	smith := &Node{Name: "smith", Attributes: `{"program": true}`}
+	if err := g.SaveAll(neo, morpheus, trinity, smith,
+		neo.Rel("knows", morpheus), neo.Rel("knows", trinity),
+		morpheus.Rel("knows", trinity), trinity.Rel("knows", smith)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	friends := g.Query(neo).Out("knows")
+	if count, err := friends.Count(); err != nil {
+		t.Fatalf("error counting: %v", err)
+	} else if count != 2 {
+		t.Errorf("expecting 2 got %v", count)
+	}
+
+	// trinity is reached from neo and from morpheus
+	if count, err := friends.Out("knows").Count(); err != nil || count != 2 {
+		t.Errorf("expecting 2 got %v (%v)", count, err)
+	}
+	if nodes, err := g.Query(neo).Out().Both().Dedup().HasLabel("person").Nodes(); err != nil {
+		t.Fatalf("error reading nodes: %v", err)
+	} else if len(nodes) != 3 {
+		t.Errorf("expecting neo, morpheus and trinity got %v", nodes)
+	}
+	if nodes, err := g.Query().In("knows").Has("name", "neo").Dedup().Nodes(); err != nil {
+		t.Fatalf("error reading nodes: %v", err)
+	} else if len(nodes) != 1 || nodes[0].Gid != neo.Gid {
+		t.Errorf("expecting neo got %v", nodes)
+	}
+
+	paths, err := g.Query(neo).Repeat(func(q *Query) *Query { return q.Out("knows") }).
+		Until(func(q *Query) *Query { return q.Has("program", true) }).Paths()
+	if err != nil {
+		t.Fatalf("error reading paths: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("expecting two paths to smith got %v", paths)
+	}
+	for _, p := range paths {
+		if p.Nodes[0].Gid != neo.Gid || p.Nodes[len(p.Nodes)-1].Gid != smith.Gid || len(p.Rids) != len(p.Nodes)-1 {
+			t.Errorf("invalid path %v", p)
+		}
+	}
+
+	selected, err := g.Query(neo).As("a").Out("knows").As("b").Out("knows").Has("name", "trinity").Select("a", "b")
+	if err != nil {
+		t.Fatalf("error selecting: %v", err)
+	}
+	if len(selected) != 1 || selected[0]["a"].Gid != neo.Gid || selected[0]["b"].Gid != morpheus.Gid {
+		t.Errorf("expecting neo and morpheus got %v", selected)
+	}
+
+	if count, err := g.Query(neo).Repeat(func(q *Query) *Query { return q.Both() }).Times(2).Count(); err != nil {
+		t.Fatalf("error counting: %v", err)
+	} else if count == 0 {
+		t.Errorf("expecting nodes at distance 2")
+	}
+	if _, err := g.Query(neo).Times(2).Count(); err != ErrInvalidStep {
+		t.Errorf("Times without Repeat should fail. got %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	trinity := &Node{Name: "trinity"}
+	tank := &Node{Name: "tank", Labels: []string{"operator"}}
+	if err := g.SaveAll(neo, morpheus, trinity, tank,
+		neo.Rel("knows", morpheus), morpheus.Rel("knows", trinity),
+		morpheus.Rel("knows", tank), neo.Rel("knows", trinity)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	// friends of friends that neo doesn't know yet
+	found, err := g.Match(Pattern{
+		Nodes: []PatternNode{{Var: "a", Ref: neo}},
+		Relations: []PatternRelation{
+			{From: "a", Name: "knows", To: "b"},
+			{From: "b", Name: "knows", To: "c"},
+			{From: "a", Name: "knows", To: "c", Not: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error matching: %v", err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("expecting one match got %v", found)
+	}
+	if found[0]["b"].Gid != morpheus.Gid || found[0]["c"].Gid != tank.Gid {
+		t.Errorf("expecting morpheus and tank got %v and %v", found[0]["b"], found[0]["c"])
+	}
+
+	// triangles, every variable is a different node
+	found, err = g.Match(Pattern{
+		Relations: []PatternRelation{
+			{From: "a", To: "b"},
+			{From: "b", To: "c"},
+			{From: "a", To: "c"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error matching: %v", err)
+	}
+	if len(found) != 1 || found[0]["a"].Gid != neo.Gid {
+		t.Errorf("expecting one triangle from neo got %v", found)
+	}
+
+	found, err = g.Match(Pattern{
+		Nodes:     []PatternNode{{Var: "op", Labels: []string{"operator"}}},
+		Relations: []PatternRelation{{From: "who", Name: "knows", To: "op"}},
+	})
+	if err != nil {
+		t.Fatalf("error matching: %v", err)
+	}
+	if len(found) != 1 || found[0]["who"].Gid != morpheus.Gid {
+		t.Errorf("expecting morpheus got %v", found)
+	}
+
+	// parallel relations don't repeat the binding
+	if err := g.SetRelationRule(RelationRule{Name: "paid", Multi: true}); err != nil {
+		t.Fatalf("error saving rule: %v", err)
+	}
+	if err := g.SaveAll(neo.Rel("paid", tank), neo.Rel("paid", tank)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	found, err = g.Match(Pattern{Relations: []PatternRelation{{From: "a", Name: "paid", To: "b"}}})
+	if err != nil {
+		t.Fatalf("error matching: %v", err)
+	}
+	if len(found) != 1 || found[0]["a"].Gid != neo.Gid || found[0]["b"].Gid != tank.Gid {
+		t.Errorf("expecting neo and tank once got %v", found)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	if err := g.SaveAll(neo, morpheus, neo.Rel("knows", morpheus)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+
+	profile, err := g.Explain(true, func() error {
+		_, err := g.Walk(neo, "knows")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error walking: %v", err)
+	}
+	var walk *data.Statement
+	for i, st := range profile.Statements {
+		if st.Call == "WalkEach" {
+			walk = &profile.Statements[i]
+		}
+	}
+	if walk == nil {
+		t.Fatalf("the walk statement wasn't recorded: %v", profile)
+	}
+	if walk.Rows != 1 || len(walk.Args) == 0 || walk.Args[0] != uint64(neo.Gid) {
+		t.Errorf("unexpected statement: %v", profile)
+	}
+	if !strings.Contains(walk.Plan, "Buffers") && !strings.Contains(walk.Plan, "actual time") {
+		t.Errorf("expecting the explain analyze output got %q (%v)", walk.Plan, walk.PlanErr)
+	}
+	if calls := profile.Calls(); len(calls) == 0 || profile.Total() <= 0 {
+		t.Errorf("expecting the timings by call got %v", calls)
+	}
+
+	// writes aren't explained, since they would run twice
+	profile, err = g.Explain(true, func() error {
+		return g.SaveAll(&Node{Name: "trinity"})
+	})
+	if err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+	for _, st := range profile.Statements {
+		if strings.HasPrefix(st.SQL, "insert") && len(st.Plan) > 0 {
+			t.Errorf("insert should not be explained: %v", st.SQL)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	rec := trace.NewRecorder()
+	root := rec.Start(nil, "request")
+	g.Trace(rec, root)
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	if err := g.SaveAll(neo, morpheus, neo.Rel("knows", morpheus)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	if _, err := g.Walk(neo, "knows"); err != nil {
+		t.Fatalf("error walking: %v", err)
+	}
+	g.Trace(nil, nil)
+	root.End()
+	if len(g.repo.Hooks) != 0 {
+		t.Errorf("the hook should be removed when tracing stops. got %v", g.repo.Hooks)
+	}
+
+	saves := rec.Find("ograph.SaveAll")
+	if len(saves) != 1 {
+		t.Fatalf("expecting one SaveAll span got %v", rec.Spans())
+	}
+	save := saves[0]
+	if save.Parent != root || !save.Ended() || save.Err != nil {
+		t.Errorf("unexpected SaveAll span: %v", save)
+	}
+	if ids, ok := save.Attributes["ograph.node_ids"].([]uint64); !ok || len(ids) != 2 || ids[0] != uint64(neo.Gid) {
+		t.Errorf("expecting the node ids got %v", save.Attributes["ograph.node_ids"])
+	}
+	if names := save.Attributes["ograph.relation_names"]; !reflect.DeepEqual(names, []string{"knows"}) {
+		t.Errorf("expecting %v got %v", []string{"knows"}, names)
+	}
+	statements := rec.Children(save)
+	if len(statements) == 0 {
+		t.Fatalf("expecting the statements of SaveAll as children")
+	}
+	for _, st := range statements {
+		if st.Name != "ograph.statement" || !st.Ended() || st.Attributes["db.statement"] == "" {
+			t.Errorf("unexpected statement span: %v", st)
+		}
+	}
+
+	walks := rec.Find("ograph.Walk")
+	if len(walks) != 1 {
+		t.Fatalf("expecting one Walk span got %v", rec.Spans())
+	}
+	if rows := walks[0].Attributes["ograph.rows"]; rows != 1 {
+		t.Errorf("expecting %v got %v", 1, rows)
+	}
+	if id := walks[0].Attributes["ograph.node_id"]; id != uint64(neo.Gid) {
+		t.Errorf("expecting %v got %v", neo.Gid, id)
+	}
+
+	// the hook follows the Repo given to Use
+	rec.Reset()
+	g.Trace(rec, nil)
+	previous := g.repo
+	g.Use(&data.Repo{Db: previous.Db, Keywords: previous.Keywords})
+	if _, err := g.Walk(neo, "knows"); err != nil {
+		t.Fatalf("error walking: %v", err)
+	}
+	g.Trace(nil, nil)
+	if len(previous.Hooks) != 0 || len(rec.Find("ograph.statement")) == 0 {
+		t.Errorf("statements should be traced on the new repo. got %v", rec.Spans())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	m := g.Metrics()
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	if err := g.SaveAll(neo, morpheus, neo.Rel("knows", morpheus)); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	if _, err := g.Walk(neo, "knows"); err != nil {
+		t.Fatalf("error walking: %v", err)
+	}
+	if _, err := g.Relation(Rid(1<<40), nil); err != ErrNotFound {
+		t.Fatalf("expecting %v got %v", ErrNotFound, err)
+	}
+	if _, err := g.Node(nil, "nobody", nil); err != ErrNotFound {
+		t.Fatalf("expecting %v got %v", ErrNotFound, err)
+	}
+	if err := g.SetNodeSchema("operator", `{"required": ["ship"]}`); err != nil {
+		t.Fatalf("error registering node schema: %v", err)
+	}
+	tank := &Node{Name: "tank", Labels: []string{"operator"}, Attributes: `{}`}
+	if _, ok := g.SaveAll(tank).(*ValidationError); !ok {
+		t.Fatalf("expecting a validation error saving %v", tank)
+	}
+
+	if v := m.NodeWrites.Value("save"); v != 2 {
+		t.Errorf("expecting %v node writes got %v", 2, v)
+	}
+	if v := m.RelationWrites.Value("save"); v != 1 {
+		t.Errorf("expecting %v relation writes got %v", 1, v)
+	}
+	if count, rows := m.WalkRows.Count(); count != 1 || rows != 1 {
+		t.Errorf("expecting one walk with one row got %v walks with %v rows", count, rows)
+	}
+	if v := m.Transactions.Value("commit"); v < 1 {
+		t.Errorf("expecting a commit got %v", v)
+	}
+	if v := m.KeywordLookups.Value("cache") + m.KeywordLookups.Value("database"); v < 1 {
+		t.Errorf("expecting a keyword lookup got %v", v)
+	}
+	if v := m.Errors.Value("not_found"); v != 2 {
+		t.Errorf("expecting %v not_found errors got %v", 2, v)
+	}
+	if v := m.Errors.Value("validation"); v != 1 {
+		t.Errorf("expecting %v validation errors got %v", 1, v)
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `ograph_node_writes_total{op="save"} 2`) {
+		t.Errorf("unexpected metrics output:\n%v", body)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	g := mustOpenGraph(t)
+	defer g.Close()
+
+	neo := &Node{Name: "neo"}
+	morpheus := &Node{Name: "morpheus"}
+	knows := neo.Rel("knows", morpheus)
+	if err := g.SaveAll(neo, morpheus, knows); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	changes, err := g.Changes("", 10)
+	if err != nil {
+		t.Fatalf("error reading changes: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expecting 3 changes got %v", changes)
+	}
+	if c := changes[0]; c.Kind != NodeChange || c.Op != Inserted || c.Node != neo.Gid || c.Name != "neo" {
+		t.Errorf("unexpected change: %v", c)
+	}
+	if c := changes[2]; c.Kind != RelationChange || c.Op != Inserted || c.Relation != knows.Rid ||
+		c.From != neo.Gid || c.To != morpheus.Gid || c.Name != "knows" {
+		t.Errorf("unexpected change: %v", c)
+	}
+	cursor := changes[2].Cursor
+	if more, err := g.Changes(cursor, 10); err != nil || len(more) != 0 {
+		t.Errorf("expecting no changes after %v got %v (%v)", cursor, more, err)
+	}
+
+	received := make(chan Change, 10)
+	sub, err := g.Subscribe(cursor, func(c Change) error {
+		received <- c
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	defer sub.Close()
+	// removing the node removes its relations first
+	if err := g.DeleteAll(neo); err != nil {
+		t.Fatalf("error deleting: %v", err)
+	}
+	expected := []struct {
+		kind ChangeKind
+		op   ChangeOp
+	}{{RelationChange, Deleted}, {NodeChange, Deleted}}
+	for _, e := range expected {
+		select {
+		case c := <-received:
+			if c.Kind != e.kind || c.Op != e.op {
+				t.Errorf("expecting %v %v got %v", e.kind, e.op, c)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v %v", e.kind, e.op)
+		}
+	}
+	if err := sub.Close(); err != nil {
+		t.Errorf("error closing the subscription: %v", err)
+	}
+	if more, err := g.Changes(sub.Cursor(), 10); err != nil || len(more) != 0 {
+		t.Errorf("expecting no changes after %v got %v (%v)", sub.Cursor(), more, err)
+	}
+
+	// an existing endpoint found by name isn't written again
+	trusts := Rel(&Node{Name: "morpheus"}, "trusts", &Node{Name: "trinity"})
+	if err := g.SaveAll(trusts); err != nil {
+		t.Fatalf("error saving all: %v", err)
+	}
+	more, err := g.Changes(sub.Cursor(), 10)
+	if err != nil {
+		t.Fatalf("error reading changes: %v", err)
+	}
+	if len(more) != 2 || more[0].Node != trusts.To.Gid || more[1].Relation != trusts.Rid {
+		t.Errorf("expecting the insert of trinity and trusts got %v", more)
+	}
+
+	// renaming is logged, the relation keeps the name it was written with
+	if err := g.RenameRelation("trusts", "believes"); err != nil {
+		t.Fatalf("error renaming relation: %v", err)
+	}
+	more, err = g.Changes(sub.Cursor(), 10)
+	if err != nil {
+		t.Fatalf("error reading changes: %v", err)
+	}
+	if len(more) != 3 || more[1].Name != "trusts" {
+		t.Fatalf("expecting the relation written as trusts got %v", more)
+	}
+	if c := more[2]; c.Kind != RelationNameChange || c.Op != Updated || c.Name != "believes" || c.OldName != "trusts" {
+		t.Errorf("unexpected change: %v", c)
+	}
+
+	if err := g.TrimChanges(more[1].Cursor); err != nil {
+		t.Fatalf("error trimming changes: %v", err)
+	}
+	if all, err := g.Changes("", 10); err != nil || len(all) != 1 || all[0].Cursor != more[2].Cursor {
+		t.Errorf("expecting only %v after trimming got %v (%v)", more[2], all, err)
+	}
+}
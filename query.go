@@ -0,0 +1,282 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"fmt"
+	"github.com/andrebq/ograph/data"
+)
+
+// Query starts a traversal from the given nodes, or from every node
+// of the graph when from is empty.
+//
+// Steps return a new Query, so a Query can be used as the prefix of many others:
+//
+//	friends := g.Query(neo).Out("knows").Dedup()
+//	count, err := friends.Count()
+//	names, err := friends.HasLabel("pilot").Nodes()
+func (g *G) Query(from ...NodeRef) *Query {
+	q := &Query{g: g}
+	if len(from) > 0 {
+		q.start = make([]uint64, len(from))
+		for i, ref := range from {
+			q.start[i] = uint64(ref.Identity().Gid)
+		}
+	}
+	return q
+}
+
+// with returns a copy of q with another step
+func (q *Query) with(st data.Step) *Query {
+	out := *q
+	out.steps = append(q.steps[:len(q.steps):len(q.steps)], st)
+	return &out
+}
+
+// Out moves to the nodes pointed by relations with any of the names,
+// or with any name when names is empty
+func (q *Query) Out(names ...string) *Query {
+	return q.with(data.Step{Kind: data.StepOut, Names: names})
+}
+
+// In moves to the nodes that point to the current one
+func (q *Query) In(names ...string) *Query {
+	return q.with(data.Step{Kind: data.StepIn, Names: names})
+}
+
+// Both moves to the nodes connected in any direction
+func (q *Query) Both(names ...string) *Query {
+	return q.with(data.Step{Kind: data.StepBoth, Names: names})
+}
+
+// Has keeps the nodes where the top-level attribute key is equal to value,
+// the key "name" compares the name of the node
+func (q *Query) Has(key string, value interface{}) *Query {
+	return q.with(data.Step{Kind: data.StepHas, Key: key, Value: value})
+}
+
+// HasLabel keeps the nodes with all the labels
+func (q *Query) HasLabel(labels ...string) *Query {
+	return q.with(data.Step{Kind: data.StepHasLabel, Labels: labels})
+}
+
+// Dedup keeps only one path to each node, the shortest one
+func (q *Query) Dedup() *Query {
+	return q.with(data.Step{Kind: data.StepDedup})
+}
+
+// As names the current node so Select can return it later
+func (q *Query) As(name string) *Query {
+	for _, m := range q.marks {
+		if m == name {
+			out := *q
+			out.err = fmt.Errorf("%v is used twice by As", name)
+			return &out
+		}
+	}
+	out := q.with(data.Step{Kind: data.StepAs})
+	out.marks = append(q.marks[:len(q.marks):len(q.marks)], name)
+	return out
+}
+
+// Repeat applies the steps added by body to an empty Query, until
+// the node matches Until or Times repetitions. A path inside a Repeat
+// never visits the same node twice.
+//
+// Only Out, In, Both, Has and HasLabel can be repeated:
+//
+//	g.Query(neo).Repeat(func(q *Query) *Query { return q.Out("knows") }).
+//		Until(func(q *Query) *Query { return q.Has("name", "smith") })
+func (q *Query) Repeat(body func(*Query) *Query) *Query {
+	steps := body(&Query{}).steps
+	return q.with(data.Step{Kind: data.StepRepeat, Body: steps})
+}
+
+// Until stops the previous Repeat on the nodes that pass the Has and
+// HasLabel steps added by cond, only those nodes are kept unless Times is used
+func (q *Query) Until(cond func(*Query) *Query) *Query {
+	return q.updateRepeat(func(st *data.Step) {
+		st.Until = cond(&Query{}).steps
+	})
+}
+
+// Times limits how many times the previous Repeat runs, without Until
+// only the nodes reached after exactly n repetitions are kept
+func (q *Query) Times(n int) *Query {
+	return q.updateRepeat(func(st *data.Step) {
+		st.Times = n
+	})
+}
+
+func (q *Query) updateRepeat(fn func(*data.Step)) *Query {
+	out := *q
+	if len(q.steps) == 0 || q.steps[len(q.steps)-1].Kind != data.StepRepeat {
+		out.err = ErrInvalidStep
+		return &out
+	}
+	out.steps = append([]data.Step(nil), q.steps...)
+	fn(&out.steps[len(out.steps)-1])
+	return &out
+}
+
+func (q *Query) traversal() (*data.Traversal, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	if q.g == nil {
+		// the empty Query given to Repeat and Until
+		return nil, ErrInvalidStep
+	}
+	return &data.Traversal{Start: q.start, Steps: q.steps}, nil
+}
+
+// Nodes returns the nodes reached by the query, once for each path
+// unless Dedup is used
+func (q *Query) Nodes() (_ []*Node, err error) {
+	defer q.g.returnError(&err)
+	t, err := q.traversal()
+	if err != nil {
+		return nil, err
+	}
+	var out []*Node
+	err = q.g.repo.TraverseEach(t, func(tr *data.Traverser) error {
+		out = append(out, nodeFromData(&tr.Node))
+		return nil
+	})
+	return out, err
+}
+
+// Count returns how many nodes the query reaches
+func (q *Query) Count() (_ int64, err error) {
+	defer q.g.returnError(&err)
+	t, err := q.traversal()
+	if err != nil {
+		return 0, err
+	}
+	count, err := q.g.repo.TraverseCount(t)
+	return count, err
+}
+
+// Paths returns the path walked to reach each node
+func (q *Query) Paths() (_ []Path, err error) {
+	defer q.g.returnError(&err)
+	t, err := q.traversal()
+	if err != nil {
+		return nil, err
+	}
+	var traversers []*data.Traverser
+	err = q.g.repo.TraverseEach(t, func(tr *data.Traverser) error {
+		traversers = append(traversers, tr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var gids []uint64
+	for _, tr := range traversers {
+		gids = append(gids, tr.Path...)
+	}
+	nodes, err := q.loadNodes(gids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Path, len(traversers))
+	for i, tr := range traversers {
+		for _, gid := range tr.Path {
+			out[i].Nodes = append(out[i].Nodes, nodes[gid])
+		}
+		for _, rid := range tr.Rids {
+			out[i].Rids = append(out[i].Rids, Rid(rid))
+		}
+	}
+	return out, nil
+}
+
+// Select returns the nodes named by As for each path, by name.
+// Without names all the nodes named by As are returned.
+func (q *Query) Select(names ...string) (_ []map[string]*Node, err error) {
+	defer q.g.returnError(&err)
+	t, err := q.traversal()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		names = q.marks
+	}
+	idx := make([]int, len(names))
+	for i, name := range names {
+		idx[i] = -1
+		for j, m := range q.marks {
+			if m == name {
+				idx[i] = j
+			}
+		}
+		if idx[i] < 0 {
+			return nil, fmt.Errorf("%v is not used by As", name)
+		}
+	}
+	var marks [][]uint64
+	err = q.g.repo.TraverseEach(t, func(tr *data.Traverser) error {
+		marks = append(marks, tr.Marks)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var gids []uint64
+	for _, m := range marks {
+		gids = append(gids, m...)
+	}
+	nodes, err := q.loadNodes(gids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]map[string]*Node, len(marks))
+	for i, m := range marks {
+		out[i] = make(map[string]*Node, len(names))
+		for j, name := range names {
+			out[i][name] = nodes[m[idx[j]]]
+		}
+	}
+	return out, nil
+}
+
+// loadNodes reads the nodes in one query, the same gid shares the same *Node
+func (q *Query) loadNodes(gids []uint64) (map[uint64]*Node, error) {
+	out := make(map[uint64]*Node)
+	var missing []uint64
+	for _, gid := range gids {
+		if _, ok := out[gid]; !ok {
+			out[gid] = nil
+			missing = append(missing, gid)
+		}
+	}
+	if len(missing) == 0 {
+		return out, nil
+	}
+	raw, err := q.g.repo.FetchNodes(missing)
+	if err != nil {
+		return nil, err
+	}
+	for i := range raw {
+		out[raw[i].Gid] = nodeFromData(&raw[i])
+	}
+	return out, nil
+}
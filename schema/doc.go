@@ -0,0 +1,2 @@
+// schema validates the attributes of nodes and relations using a subset of JSON Schema
+package schema
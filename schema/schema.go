@@ -0,0 +1,489 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+type (
+	// Schema is a parsed JSON Schema.
+	//
+	// Only the validation keywords are supported: type, enum, const,
+	// properties, required, additionalProperties, minProperties, maxProperties,
+	// items, minItems, maxItems, uniqueItems, minimum, maximum,
+	// exclusiveMinimum, exclusiveMaximum, multipleOf, minLength, maxLength,
+	// pattern, allOf, anyOf, oneOf and not. Other keywords are ignored,
+	// except $ref which is rejected by Parse.
+	Schema struct {
+		always *bool
+
+		types []string
+		enum  []interface{}
+		konst *interface{}
+
+		properties           map[string]*Schema
+		required             []string
+		additionalProperties *Schema
+		minProperties        *int
+		maxProperties        *int
+
+		items       *Schema
+		minItems    *int
+		maxItems    *int
+		uniqueItems bool
+
+		minimum          *float64
+		maximum          *float64
+		exclusiveMinimum *float64
+		exclusiveMaximum *float64
+		multipleOf       *float64
+
+		minLength *int
+		maxLength *int
+		pattern   *regexp.Regexp
+
+		allOf []*Schema
+		anyOf []*Schema
+		oneOf []*Schema
+		not   *Schema
+	}
+
+	// Violation describes why a value doesn't conform to a schema
+	Violation struct {
+		// Path to the offending value, $ is the document root
+		Path    string
+		Message string
+	}
+)
+
+// Parse reads a JSON Schema
+func Parse(raw string) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, err
+	}
+	return compile(doc, "$")
+}
+
+// Validate checks the JSON document against the schema, a document
+// that isn't valid JSON results in an error
+func (s *Schema) Validate(doc string) ([]Violation, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(doc), &value); err != nil {
+		return nil, err
+	}
+	return s.ValidateValue(value), nil
+}
+
+// ValidateValue checks a value decoded by encoding/json against the schema
+func (s *Schema) ValidateValue(value interface{}) []Violation {
+	var out []Violation
+	s.validate(value, "$", &out)
+	return out
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%v: %v", v.Path, v.Message)
+}
+
+func compile(doc interface{}, at string) (*Schema, error) {
+	if b, ok := doc.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: schema must be an object or a boolean", at)
+	}
+	if _, ok := obj["$ref"]; ok {
+		return nil, fmt.Errorf("%v: $ref is not supported", at)
+	}
+	c := compiler{obj: obj, at: at}
+	s := &Schema{}
+
+	switch t := obj["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v/type: must be a string or an array of strings", at)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%v/type: must be a string or an array of strings", at)
+	}
+	if e, ok := obj["enum"]; ok {
+		if s.enum, ok = e.([]interface{}); !ok {
+			return nil, fmt.Errorf("%v/enum: must be an array", at)
+		}
+	}
+	if k, ok := obj["const"]; ok {
+		s.konst = &k
+	}
+
+	if p, ok := obj["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v/properties: must be an object", at)
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, sub := range props {
+			compiled, err := compile(sub, at+"/properties/"+name)
+			if err != nil {
+				return nil, err
+			}
+			s.properties[name] = compiled
+		}
+	}
+	if r, ok := obj["required"]; ok {
+		list, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v/required: must be an array of strings", at)
+		}
+		for _, v := range list {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v/required: must be an array of strings", at)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	s.additionalProperties = c.schema("additionalProperties")
+	s.minProperties = c.integer("minProperties")
+	s.maxProperties = c.integer("maxProperties")
+
+	s.items = c.schema("items")
+	s.minItems = c.integer("minItems")
+	s.maxItems = c.integer("maxItems")
+	if u, ok := obj["uniqueItems"].(bool); ok {
+		s.uniqueItems = u
+	}
+
+	s.minimum = c.number("minimum")
+	s.maximum = c.number("maximum")
+	s.exclusiveMinimum = c.number("exclusiveMinimum")
+	s.exclusiveMaximum = c.number("exclusiveMaximum")
+	s.multipleOf = c.number("multipleOf")
+
+	s.minLength = c.integer("minLength")
+	s.maxLength = c.integer("maxLength")
+	if p, ok := obj["pattern"]; ok {
+		str, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v/pattern: must be a string", at)
+		}
+		re, err := regexp.Compile(str)
+		if err != nil {
+			return nil, fmt.Errorf("%v/pattern: %v", at, err)
+		}
+		s.pattern = re
+	}
+
+	s.allOf = c.schemas("allOf")
+	s.anyOf = c.schemas("anyOf")
+	s.oneOf = c.schemas("oneOf")
+	s.not = c.schema("not")
+	return s, c.err
+}
+
+// compiler reads the keywords of a schema object, keeping the first error
+type compiler struct {
+	obj map[string]interface{}
+	at  string
+	err error
+}
+
+func (c *compiler) schema(key string) *Schema {
+	v, ok := c.obj[key]
+	if !ok || c.err != nil {
+		return nil
+	}
+	var s *Schema
+	s, c.err = compile(v, c.at+"/"+key)
+	return s
+}
+
+func (c *compiler) schemas(key string) []*Schema {
+	v, ok := c.obj[key]
+	if !ok || c.err != nil {
+		return nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		c.err = fmt.Errorf("%v/%v: must be an array of schemas", c.at, key)
+		return nil
+	}
+	out := make([]*Schema, len(list))
+	for i, item := range list {
+		if out[i], c.err = compile(item, fmt.Sprintf("%v/%v/%d", c.at, key, i)); c.err != nil {
+			return nil
+		}
+	}
+	return out
+}
+
+func (c *compiler) number(key string) *float64 {
+	v, ok := c.obj[key]
+	if !ok || c.err != nil {
+		return nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		c.err = fmt.Errorf("%v/%v: must be a number", c.at, key)
+		return nil
+	}
+	return &n
+}
+
+func (c *compiler) integer(key string) *int {
+	n := c.number(key)
+	if n == nil {
+		return nil
+	}
+	if *n < 0 || *n != math.Trunc(*n) {
+		c.err = fmt.Errorf("%v/%v: must be a non-negative integer", c.at, key)
+		return nil
+	}
+	i := int(*n)
+	return &i
+}
+
+func (s *Schema) validate(value interface{}, path string, out *[]Violation) {
+	fail := func(format string, args ...interface{}) {
+		*out = append(*out, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.always != nil {
+		if !*s.always {
+			fail("no value is allowed")
+		}
+		return
+	}
+
+	if len(s.types) > 0 && !s.matchesType(value) {
+		fail("expecting %v got %v", joinTypes(s.types), typeOf(value))
+		// the other keywords would only repeat the same problem
+		return
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v", jsonText(s.enum))
+		}
+	}
+	if s.konst != nil && !reflect.DeepEqual(*s.konst, value) {
+		fail("must be %v", jsonText(*s.konst))
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		s.validateObject(value, path, out, fail)
+	case []interface{}:
+		s.validateArray(value, path, out, fail)
+	case float64:
+		s.validateNumber(value, fail)
+	case string:
+		s.validateString(value, fail)
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(value, path, out)
+	}
+	if len(s.anyOf) > 0 && s.countMatches(s.anyOf, value) == 0 {
+		fail("must match at least one schema in anyOf")
+	}
+	if len(s.oneOf) > 0 {
+		if n := s.countMatches(s.oneOf, value); n != 1 {
+			fail("must match exactly one schema in oneOf, matched %v", n)
+		}
+	}
+	if s.not != nil && len(s.not.ValidateValue(value)) == 0 {
+		fail("must not match the schema in not")
+	}
+}
+
+func (s *Schema) validateObject(obj map[string]interface{}, path string, out *[]Violation, fail func(string, ...interface{})) {
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			fail("missing required property %q", name)
+		}
+	}
+	if s.minProperties != nil && len(obj) < *s.minProperties {
+		fail("must have at least %v properties", *s.minProperties)
+	}
+	if s.maxProperties != nil && len(obj) > *s.maxProperties {
+		fail("must have at most %v properties", *s.maxProperties)
+	}
+	// sorted to keep the violations in a stable order
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, ok := s.properties[name]
+		if !ok {
+			sub = s.additionalProperties
+		}
+		if sub != nil {
+			sub.validate(obj[name], propertyPath(path, name), out)
+		}
+	}
+}
+
+func (s *Schema) validateArray(list []interface{}, path string, out *[]Violation, fail func(string, ...interface{})) {
+	if s.minItems != nil && len(list) < *s.minItems {
+		fail("must have at least %v items", *s.minItems)
+	}
+	if s.maxItems != nil && len(list) > *s.maxItems {
+		fail("must have at most %v items", *s.maxItems)
+	}
+	if s.uniqueItems {
+		for i := range list {
+			for j := i + 1; j < len(list); j++ {
+				if reflect.DeepEqual(list[i], list[j]) {
+					fail("items %v and %v are equal", i, j)
+				}
+			}
+		}
+	}
+	if s.items != nil {
+		for i, item := range list {
+			s.items.validate(item, fmt.Sprintf("%v[%d]", path, i), out)
+		}
+	}
+}
+
+func (s *Schema) validateNumber(n float64, fail func(string, ...interface{})) {
+	if s.minimum != nil && n < *s.minimum {
+		fail("must be >= %v", *s.minimum)
+	}
+	if s.maximum != nil && n > *s.maximum {
+		fail("must be <= %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum {
+		fail("must be > %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum {
+		fail("must be < %v", *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil && *s.multipleOf != 0 {
+		// n / m isn't exact for decimals, 0.3 / 0.1 is 2.9999999999999996
+		q := n / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9*math.Max(1, math.Abs(q)) {
+			fail("must be a multiple of %v", *s.multipleOf)
+		}
+	}
+}
+
+func (s *Schema) validateString(str string, fail func(string, ...interface{})) {
+	length := utf8.RuneCountInString(str)
+	if s.minLength != nil && length < *s.minLength {
+		fail("must have at least %v characters", *s.minLength)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		fail("must have at most %v characters", *s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		fail("must match %q", s.pattern.String())
+	}
+}
+
+func (s *Schema) countMatches(schemas []*Schema, value interface{}) int {
+	n := 0
+	for _, sub := range schemas {
+		if len(sub.ValidateValue(value)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Schema) matchesType(value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of a value decoded by encoding/json
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func joinTypes(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("one of %v", types)
+}
+
+func jsonText(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(buf)
+}
+
+var simpleName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func propertyPath(parent, name string) string {
+	if simpleName.MatchString(name) {
+		return parent + "." + name
+	}
+	return parent + "[" + strconv.Quote(name) + "]"
+}
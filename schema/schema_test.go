@@ -0,0 +1,106 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	s, err := Parse(`{
+		"type": "object",
+		"required": ["name", "age"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["red", "blue"]}, "uniqueItems": true}
+		},
+		"additionalProperties": false
+	}`)
+	if err != nil {
+		t.Fatalf("error parsing schema: %v", err)
+	}
+
+	if violations, err := s.Validate(`{"name": "neo", "age": 30, "tags": ["red"]}`); err != nil {
+		t.Fatalf("error validating: %v", err)
+	} else if len(violations) != 0 {
+		t.Fatalf("valid document should not have violations. got %v", violations)
+	}
+
+	violations, err := s.Validate(`{"name": "", "age": 1.5, "tags": ["red", "green", "red"], "ship": true}`)
+	if err != nil {
+		t.Fatalf("error validating: %v", err)
+	}
+	expected := []Violation{
+		{Path: "$.age", Message: "expecting integer got number"},
+		{Path: "$.name", Message: "must have at least 1 characters"},
+		{Path: "$.ship", Message: "no value is allowed"},
+		{Path: "$.tags", Message: "items 0 and 2 are equal"},
+		{Path: "$.tags[1]", Message: `must be one of ["red","blue"]`},
+	}
+	if !reflect.DeepEqual(violations, expected) {
+		t.Fatalf("invalid violations. expecting %v got %v", expected, violations)
+	}
+
+	if violations, _ := s.Validate(`[]`); len(violations) != 1 || violations[0].Path != "$" {
+		t.Fatalf("array should not be accepted as the root. got %v", violations)
+	}
+}
+
+func TestMultipleOf(t *testing.T) {
+	for _, c := range []struct {
+		schema, doc string
+		valid       bool
+	}{
+		{`{"multipleOf": 0.1}`, `0.3`, true},
+		{`{"multipleOf": 0.01}`, `19.99`, true},
+		{`{"multipleOf": 3}`, `9`, true},
+		{`{"multipleOf": 0.1}`, `0.35`, false},
+		{`{"multipleOf": 3}`, `10`, false},
+	} {
+		s, err := Parse(c.schema)
+		if err != nil {
+			t.Fatalf("error parsing schema: %v", err)
+		}
+		violations, err := s.Validate(c.doc)
+		if err != nil {
+			t.Fatalf("error validating: %v", err)
+		}
+		if valid := len(violations) == 0; valid != c.valid {
+			t.Errorf("%v with %v: expecting valid %v got %v", c.doc, c.schema, c.valid, violations)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, raw := range []string{
+		`[]`,
+		`{"type": 1}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"$ref": "#/definitions/a"}`,
+		`{"properties": {"a": {"items": 1}}}`,
+	} {
+		if _, err := Parse(raw); err == nil {
+			t.Errorf("%v should not be a valid schema", raw)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+// trace defines the tracer used by ograph to report spans, and a Recorder that keeps them in memory
+package trace
@@ -0,0 +1,156 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package trace
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Tracer creates spans. Adapters to other tracing libraries implement
+	// it, usually by wrapping their spans in a type that implements Span.
+	Tracer interface {
+		// Start begins a span, parent is nil for a root span
+		Start(parent Span, name string) Span
+	}
+
+	// Span is an operation being traced
+	Span interface {
+		SetAttribute(key string, value interface{})
+		// SetError marks the span as failed
+		SetError(err error)
+		End()
+	}
+
+	// Recorder is a Tracer that keeps the spans in memory, useful for tests
+	Recorder struct {
+		lock  sync.Mutex
+		spans []*RecordedSpan
+	}
+
+	// RecordedSpan is a span created by a Recorder
+	RecordedSpan struct {
+		Name       string
+		Parent     *RecordedSpan
+		Attributes map[string]interface{}
+		Err        error
+		Start      time.Time
+		// zero until End is called
+		Finish time.Time
+
+		recorder *Recorder
+	}
+
+	noop struct{}
+)
+
+// Noop is a span that does nothing
+var Noop Span = noop{}
+
+func (noop) SetAttribute(string, interface{}) {}
+func (noop) SetError(error)                   {}
+func (noop) End()                             {}
+
+// NewRecorder returns an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Start implements Tracer, parent must be nil or a span from the same Recorder
+func (r *Recorder) Start(parent Span, name string) Span {
+	s := &RecordedSpan{
+		Name:       name,
+		Attributes: make(map[string]interface{}),
+		Start:      time.Now(),
+		recorder:   r,
+	}
+	if p, ok := parent.(*RecordedSpan); ok {
+		s.Parent = p
+	}
+	r.lock.Lock()
+	r.spans = append(r.spans, s)
+	r.lock.Unlock()
+	return s
+}
+
+// Spans returns the spans in the order they started
+func (r *Recorder) Spans() []*RecordedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*RecordedSpan(nil), r.spans...)
+}
+
+// Find returns the spans with the given name
+func (r *Recorder) Find(name string) []*RecordedSpan {
+	var out []*RecordedSpan
+	for _, s := range r.Spans() {
+		if s.Name == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Children returns the spans started with s as the parent
+func (r *Recorder) Children(s *RecordedSpan) []*RecordedSpan {
+	var out []*RecordedSpan
+	for _, c := range r.Spans() {
+		if c.Parent == s {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Reset discards the recorded spans
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	r.spans = nil
+	r.lock.Unlock()
+}
+
+// SetAttribute implements Span
+func (s *RecordedSpan) SetAttribute(key string, value interface{}) {
+	s.recorder.lock.Lock()
+	s.Attributes[key] = value
+	s.recorder.lock.Unlock()
+}
+
+// SetError implements Span
+func (s *RecordedSpan) SetError(err error) {
+	s.recorder.lock.Lock()
+	s.Err = err
+	s.recorder.lock.Unlock()
+}
+
+// End implements Span
+func (s *RecordedSpan) End() {
+	s.recorder.lock.Lock()
+	s.Finish = time.Now()
+	s.recorder.lock.Unlock()
+}
+
+// Ended checks if End was called
+func (s *RecordedSpan) Ended() bool {
+	s.recorder.lock.Lock()
+	defer s.recorder.lock.Unlock()
+	return !s.Finish.IsZero()
+}
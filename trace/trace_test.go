@@ -0,0 +1,60 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package trace
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	root := r.Start(nil, "root")
+	child := r.Start(root, "child")
+	child.SetAttribute("rows", 10)
+	child.SetError(errors.New("broken"))
+	child.End()
+
+	spans := r.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expecting 2 spans got %v", spans)
+	}
+	if spans[1].Parent != spans[0] || spans[1].Attributes["rows"] != 10 || spans[1].Err == nil {
+		t.Errorf("unexpected child: %#v", spans[1])
+	}
+	if !spans[1].Ended() || spans[0].Ended() {
+		t.Errorf("only the child should be ended")
+	}
+	if children := r.Children(spans[0]); len(children) != 1 || children[0].Name != "child" {
+		t.Errorf("expecting the child got %v", children)
+	}
+	if found := r.Find("root"); len(found) != 1 || found[0] != spans[0] {
+		t.Errorf("expecting the root got %v", found)
+	}
+
+	// other spans are used as a root
+	if s := r.Start(Noop, "orphan").(*RecordedSpan); s.Parent != nil {
+		t.Errorf("span from another tracer should not be the parent")
+	}
+	r.Reset()
+	if len(r.Spans()) != 0 {
+		t.Errorf("reset should discard the spans")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"github.com/andrebq/ograph/data"
+	"github.com/andrebq/ograph/trace"
+)
+
+type (
+	// tracingHook reports the statements of the Repo as spans
+	// inside the active span of G
+	tracingHook struct {
+		g     *G
+		spans map[*data.Statement]trace.Span
+	}
+)
+
+// Trace reports spans for SaveAll, Node, Walk, WalkEach and for every statement
+// sent to the database. The spans are children of parent, which can be nil.
+// A nil tracer stops tracing.
+//
+// Like G, the tracer state isn't safe for concurrent use, a service should
+// call Trace with the span of the request before using G.
+func (g *G) Trace(tracer trace.Tracer, parent trace.Span) {
+	g.tracer = tracer
+	g.parentSpan = parent
+	g.activeSpan = nil
+	if tracer == nil {
+		g.detachTraceHook()
+	} else {
+		g.attachTraceHook()
+	}
+}
+
+// attachTraceHook adds the hook that reports the statements to the Repo,
+// once, see Use
+func (g *G) attachTraceHook() {
+	if g.traceHook != nil || g.repo == nil {
+		return
+	}
+	g.traceHook = &tracingHook{g: g, spans: make(map[*data.Statement]trace.Span)}
+	g.repo.Hooks = append(g.repo.Hooks, g.traceHook)
+}
+
+// detachTraceHook removes the hook, so statements aren't observed
+// when nothing is traced
+func (g *G) detachTraceHook() {
+	if g.traceHook == nil {
+		return
+	}
+	var hooks []data.Hook
+	for _, h := range g.repo.Hooks {
+		if h != data.Hook(g.traceHook) {
+			hooks = append(hooks, h)
+		}
+	}
+	g.repo.Hooks = hooks
+	g.traceHook = nil
+}
+
+// startSpan starts a span for an operation of G, end must be called
+// with the result of the operation
+func (g *G) startSpan(name string) (span trace.Span, end func(error)) {
+	if g.tracer == nil {
+		return trace.Noop, func(error) {}
+	}
+	previous := g.activeSpan
+	span = g.tracer.Start(g.currentSpan(), name)
+	g.activeSpan = span
+	return span, func(err error) {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+		g.activeSpan = previous
+	}
+}
+
+func (g *G) currentSpan() trace.Span {
+	if g.activeSpan != nil {
+		return g.activeSpan
+	}
+	return g.parentSpan
+}
+
+func (h *tracingHook) Before(st *data.Statement) {
+	if h.g.tracer == nil {
+		return
+	}
+	span := h.g.tracer.Start(h.g.currentSpan(), "ograph.statement")
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", st.SQL)
+	span.SetAttribute("ograph.call", st.Call)
+	h.spans[st] = span
+}
+
+func (h *tracingHook) After(st *data.Statement) {
+	span, ok := h.spans[st]
+	if !ok {
+		return
+	}
+	delete(h.spans, st)
+	span.SetAttribute("ograph.rows", st.Rows)
+	if st.Err != nil {
+		span.SetError(st.Err)
+	}
+	span.End()
+}
+
+// traceSaved adds the ids of the saved nodes and relations to span
+func traceSaved(span trace.Span, what []interface{}) {
+	if span == trace.Noop {
+		return
+	}
+	var nodes, rids []uint64
+	var names []string
+	seen := make(map[string]bool)
+	for _, v := range what {
+		switch v := v.(type) {
+		case *Node:
+			nodes = append(nodes, uint64(v.Gid))
+		case *Upsert:
+			nodes = append(nodes, uint64(v.Node.Gid))
+		case *Relation:
+			rids = append(rids, uint64(v.Rid))
+			if !seen[v.Name] {
+				seen[v.Name] = true
+				names = append(names, v.Name)
+			}
+		}
+	}
+	span.SetAttribute("ograph.node_ids", nodes)
+	span.SetAttribute("ograph.relation_ids", rids)
+	span.SetAttribute("ograph.relation_names", names)
+}
+
+func traceWalk(span trace.Span, from NodeRef, name string) {
+	span.SetAttribute("ograph.node_id", uint64(from.Identity().Gid))
+	span.SetAttribute("ograph.relation_name", name)
+}
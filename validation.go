@@ -0,0 +1,275 @@
+// Copyright (c) 2014 André Luiz Alves Moraes 
+// 
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// 
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+// 
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package ograph
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/andrebq/ograph/data"
+	"github.com/andrebq/ograph/schema"
+)
+
+type (
+	// Returned by SaveAll when the attributes don't conform to the registered schemas
+	ValidationError struct {
+		Violations []Violation
+	}
+
+	// A single problem found while validating the attributes
+	Violation struct {
+		// Name of the node, or name of the relation
+		Subject string
+		// The label or relation name that registered the schema
+		Schema string
+		// Path inside the attributes, $ is the root
+		Path    string
+		Message string
+	}
+)
+
+// Error implements the error interface
+func (v *ValidationError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "invalid attributes:")
+	for i, violation := range v.Violations {
+		if i > 0 {
+			buf.WriteString(";")
+		}
+		fmt.Fprintf(&buf, " %v", violation)
+	}
+	return buf.String()
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%v (schema %v) %v: %v", v.Subject, v.Schema, v.Path, v.Message)
+}
+
+// SetNodeSchema registers the JSON Schema used to validate the attributes of
+// every node with the given label. An empty schema removes the current one.
+//
+// Schemas are stored in the database, other processes see them after ReloadSchemas.
+// They can be changed while other goroutines call SaveAll.
+func (g *G) SetNodeSchema(label, jsonSchema string) (err error) {
+	defer g.returnError(&err)
+	return g.setSchema(data.NodeSchema, label, jsonSchema)
+}
+
+// SetRelationSchema registers the JSON Schema used to validate the attributes of
+// the relations with the given name. An empty schema removes the current one.
+func (g *G) SetRelationSchema(name, jsonSchema string) (err error) {
+	defer g.returnError(&err)
+	return g.setSchema(data.RelationSchema, name, jsonSchema)
+}
+
+// ReloadSchemas reads the schemas from the database again, to see the
+// ones changed by other processes
+func (g *G) ReloadSchemas() (err error) {
+	defer g.returnError(&err)
+	g.schemaLock.Lock()
+	defer g.schemaLock.Unlock()
+	return g.loadSchemas()
+}
+
+func (g *G) setSchema(kind, key, jsonSchema string) error {
+	var s *schema.Schema
+	if len(jsonSchema) > 0 {
+		var err error
+		if s, err = schema.Parse(jsonSchema); err != nil {
+			return err
+		}
+	}
+	g.schemaLock.Lock()
+	defer g.schemaLock.Unlock()
+	repo := g.schemaRepo()
+	repo.SaveSchema(&data.SchemaSource{Kind: kind, Key: key, Body: jsonSchema})
+	if err := repo.End(); err != nil {
+		return err
+	}
+	if !g.schemasLoaded {
+		// loading reads the schema that was just saved
+		return g.loadSchemas()
+	}
+	if kind == data.NodeSchema {
+		g.nodeSchemas = withSchema(g.nodeSchemas, key, s)
+	} else {
+		g.relationSchemas = withSchema(g.relationSchemas, key, s)
+	}
+	return nil
+}
+
+// moveRelationSchema gives the schema of the relations named from to the
+// ones named to, an empty to removes it. The database is changed by
+// RenameKeyword and DeleteKeyword.
+func (g *G) moveRelationSchema(from, to string) {
+	g.schemaLock.Lock()
+	defer g.schemaLock.Unlock()
+	if !g.schemasLoaded {
+		return
+	}
+	s := g.relationSchemas[from]
+	relations := withSchema(g.relationSchemas, from, nil)
+	if len(to) > 0 {
+		relations = withSchema(relations, to, s)
+	}
+	g.relationSchemas = relations
+}
+
+// withSchema returns a copy of schemas with s as the schema of key,
+// a nil s removes it
+func withSchema(schemas map[string]*schema.Schema, key string, s *schema.Schema) map[string]*schema.Schema {
+	out := make(map[string]*schema.Schema, len(schemas)+1)
+	for k, v := range schemas {
+		out[k] = v
+	}
+	if s == nil {
+		delete(out, key)
+	} else {
+		out[key] = s
+	}
+	return out
+}
+
+// loadSchemas replaces the schemas with the ones stored in the database,
+// it must be called with schemaLock held
+func (g *G) loadSchemas() error {
+	sources, err := g.schemaRepo().Schemas()
+	if err != nil {
+		return err
+	}
+	nodes := make(map[string]*schema.Schema)
+	relations := make(map[string]*schema.Schema)
+	for _, src := range sources {
+		s, err := schema.Parse(src.Body)
+		if err != nil {
+			return fmt.Errorf("invalid %v schema %v: %v", src.Kind, src.Key, err)
+		}
+		if src.Kind == data.NodeSchema {
+			nodes[src.Key] = s
+		} else {
+			relations[src.Key] = s
+		}
+	}
+	g.nodeSchemas, g.relationSchemas = nodes, relations
+	g.schemasLoaded = true
+	return nil
+}
+
+// schemas returns the current schemas, loading them the first time
+func (g *G) schemas() (nodes, relations map[string]*schema.Schema, err error) {
+	g.schemaLock.RLock()
+	if g.schemasLoaded {
+		defer g.schemaLock.RUnlock()
+		return g.nodeSchemas, g.relationSchemas, nil
+	}
+	g.schemaLock.RUnlock()
+	g.schemaLock.Lock()
+	defer g.schemaLock.Unlock()
+	if !g.schemasLoaded {
+		if err := g.loadSchemas(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return g.nodeSchemas, g.relationSchemas, nil
+}
+
+// schemaRepo returns a Repo that shares the connections of g.repo, so the
+// schemas can be read and written while g.repo is in use
+func (g *G) schemaRepo() *data.Repo {
+	return &data.Repo{Db: g.repo.Db, Keywords: g.repo.Keywords, Unprepared: true}
+}
+
+// validate checks the nodes and relations before they are saved.
+// Upserts are checked after the write, since merging changes the attributes,
+// and so are the nodes that keep their stored labels.
+func (g *G) validate(what []interface{}) error {
+	nodeSchemas, relationSchemas, err := g.schemas()
+	if err != nil {
+		return err
+	}
+	if len(nodeSchemas) == 0 && len(relationSchemas) == 0 {
+		return nil
+	}
+	var violations []Violation
+	for _, v := range what {
+		var err error
+		switch v := v.(type) {
+		case *Node:
+			if v.Labels == nil && v.Gid != InvalidNid {
+				// see saveNode
+				continue
+			}
+			err = validateNode(nodeSchemas, v, &violations)
+		case *Relation:
+			err = validateAttributes(relationSchemas[v.Name], v.Name, v.Name, v.Attributes, &violations)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// validateNode checks the attributes of n against the schemas of its labels
+func (g *G) validateNode(n *Node, violations *[]Violation) error {
+	nodeSchemas, _, err := g.schemas()
+	if err != nil {
+		return err
+	}
+	return validateNode(nodeSchemas, n, violations)
+}
+
+func validateNode(nodeSchemas map[string]*schema.Schema, n *Node, violations *[]Violation) error {
+	seen := make(map[string]bool, len(n.Labels))
+	for _, label := range n.Labels {
+		if seen[label] {
+			continue
+		}
+		seen[label] = true
+		if err := validateAttributes(nodeSchemas[label], n.Name, label, n.Attributes, violations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAttributes(s *schema.Schema, subject, schemaName string, attrs Attributes, violations *[]Violation) error {
+	if s == nil {
+		return nil
+	}
+	if len(attrs) == 0 {
+		attrs = "{}"
+	}
+	found, err := s.Validate(string(attrs))
+	if err != nil {
+		return ErrInvalidEncoding
+	}
+	for _, v := range found {
+		*violations = append(*violations, Violation{
+			Subject: subject,
+			Schema:  schemaName,
+			Path:    v.Path,
+			Message: v.Message,
+		})
+	}
+	return nil
+}